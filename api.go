@@ -4,19 +4,114 @@
 
 package asink
 
+import (
+	"regexp"
+)
+
 const API_VERSION_STRING = "0.1"
 
+//The versions of the HTTP API supported by this code, oldest first. Each is
+//served under /v<version>/, and clients use the newest one supported by both
+//themselves and the server.
+var API_VERSIONS = []int{1}
+
+//header in which clients send the version of the API they are using
+const API_VERSION_HEADER = "X-Asink-API-Version"
+
+//returned by the server's root URL to advertise which versions of the API it
+//supports
+type APIVersions struct {
+	Versions         []int
+	ServerVersion    string
+	ContentTypes     []string //which may be used for requests (see CONTENT_TYPES)
+	ContentEncodings []string //which may be used for requests, i.e. "gzip"
+}
+
+func SupportsAPIVersion(version int) bool {
+	for _, v := range API_VERSIONS {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+//the share used by clients which don't specify one, and by the /events/
+//endpoints
+const DEFAULT_SHARE = "default"
+
+var shareNameRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+//Share names may only contain letters, numbers, '_', '.', and '-' so they
+//can be used in URLs without escaping
+func ValidShareName(name string) bool {
+	return shareNameRegexp.MatchString(name)
+}
+
 type APIStatus uint32
 
 const (
 	SUCCESS = 0 + iota
 	ERROR
+	REVOKED  //the device the request came from has been revoked
+	CONFLICT //the event's predecessor is no longer the latest version of its path
 )
 
+//header in which clients send the id of the device they are running on, and
+//the one in which they send its token
+const DEVICE_HEADER = "X-Asink-Device"
+const DEVICE_TOKEN_HEADER = "X-Asink-Device-Token"
+
+//A machine running a client. Clients register once with the server, which
+//assigns the device's id and the token it authenticates with, and records
+//which device each event came from.
+type Device struct {
+	Id    int64
+	Name  string
+	Token string //only sent to the device when it is registered
+}
+
+//A user's role in a share
+type ShareRole uint32
+
+const (
+	OWNER     = ShareRole(1) << iota //created the share, and may read and write it
+	READWRITE                        //may read and write the share
+	READONLY                         //may only read the share
+)
+
+func (r ShareRole) CanWrite() bool {
+	return r&(OWNER|READWRITE) != 0
+}
+
+func (r ShareRole) String() string {
+	switch r {
+	case OWNER:
+		return "owner"
+	case READWRITE:
+		return "read-write"
+	case READONLY:
+		return "read-only"
+	}
+	return "unknown"
+}
+
 type APIResponse struct {
 	Status      APIStatus
 	Explanation string
 	Events      []*Event
+	Role        ShareRole      //the requesting user's role in the share, if known
+	AsOf        int64          //for snapshots, the id of the last event they reflect
+	Results     []*EventResult //for submitted events, the result of each, in the order they were submitted
+	Device      *Device        //for device registrations, the device registered
+}
+
+//The outcome of submitting one event
+type EventResult struct {
+	Status      APIStatus
+	Explanation string
+	Id          int64  //the id the server assigned the event, if it was accepted
+	Head        *Event //for CONFLICT results, the current version of the path
 }
 
 type EventList struct {
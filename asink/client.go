@@ -11,28 +11,51 @@ import (
 	"fmt"
 	"github.com/aclindsa/asink"
 	"github.com/aclindsa/asink/util"
+	"net/rpc"
 	"os/user"
 	"path"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+//everything needed to synchronize one sync root
 type AsinkGlobals struct {
-	configFileName string
+	name           string
 	syncDir        string
 	cacheDir       string
 	tmpDir         string
-	rpcSock        string
+	selection      *Selection
+	ignore         *IgnoreRules
+	conflicts      *ConflictPolicies
+	copyName       string //template for the names of conflicted copies
+	watcher        string
+	pollInterval   time.Duration
+	settleTime     time.Duration
+	maxSettleDelay time.Duration
+	settler        *Settler //nil until the watcher is started
+	localUpdates   chan *asink.Event
+	symlinks       string
+	xattrs         bool
 	db             *AsinkDB
+	locker         *PathLocker
+	clock          *HybridClock
+	sendEventsChan chan *sendEventRequest
+	stats          *Stats
 	storage        Storage
 	server         string
+	share          string
 	port           int
+	pageSize       int //number of events to ask the server for at once, 0 for its default
+	apiLock        sync.Mutex
+	api            *apiSettings //nil until negotiated with the server
+	deviceName     string       //what to call this machine when registering it with the server
 	username       string
 	password       string
 	encrypted      bool
 	key            string
 }
 
-var globals AsinkGlobals
-
 var flags *flag.FlagSet
 
 func init() {
@@ -41,6 +64,7 @@ func init() {
 
 func StartClient(args []string) {
 	const config_usage = "Config File to use"
+	const rehash_usage = "Ignore cached file hashes and re-hash every file"
 	userHomeDir := "~"
 
 	u, err := user.Current()
@@ -48,111 +72,78 @@ func StartClient(args []string) {
 		userHomeDir = u.HomeDir
 	}
 
+	var configFileName string
+	var rehash bool
 	flags := flag.NewFlagSet("start", flag.ExitOnError)
-	flags.StringVar(&globals.configFileName, "config", path.Join(userHomeDir, ".asink", "config"), config_usage)
-	flags.StringVar(&globals.configFileName, "c", path.Join(userHomeDir, ".asink", "config"), config_usage+" (shorthand)")
+	flags.StringVar(&configFileName, "config", path.Join(userHomeDir, ".asink", "config"), config_usage)
+	flags.StringVar(&configFileName, "c", path.Join(userHomeDir, ".asink", "config"), config_usage+" (shorthand)")
+	flags.BoolVar(&rehash, "rehash", false, rehash_usage)
 	flags.Parse(args)
 
 	//make sure config file's permissions are read-write only for the current user
-	if !util.FileExistsAndHasPermissions(globals.configFileName, 384 /*0b110000000*/) {
-		fmt.Println("Error: Either the file at " + globals.configFileName + " doesn't exist, or it doesn't have permissions such that the current user is the only one allowed to read and write.")
+	if !util.FileExistsAndHasPermissions(configFileName, 384 /*0b110000000*/) {
+		fmt.Println("Error: Either the file at " + configFileName + " doesn't exist, or it doesn't have permissions such that the current user is the only one allowed to read and write.")
 		return
 	}
 
-	config, err := conf.ReadConfigFile(globals.configFileName)
+	config, err := conf.ReadConfigFile(configFileName)
 	if err != nil {
 		fmt.Println(err)
-		fmt.Println("Error reading config file at ", globals.configFileName, ". Does it exist?")
+		fmt.Println("Error reading config file at ", configFileName, ". Does it exist?")
 		return
 	}
 
-	globals.storage, err = GetStorage(config)
+	rpcSock, err := config.GetString("local", "socket") //TODO make sure this exists
+
+	roots, err := LoadRoots(config)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	globals.syncDir, err = config.GetString("local", "syncdir")
-	globals.cacheDir, err = config.GetString("local", "cachedir")
-	globals.tmpDir, err = config.GetString("local", "tmpdir")
-	globals.rpcSock, err = config.GetString("local", "socket") //TODO make sure this exists
-
-	//make sure all the necessary directories exist
-	err = util.EnsureDirExists(globals.syncDir)
-	if err != nil {
-		panic(err)
-	}
-	err = util.EnsureDirExists(globals.cacheDir)
-	if err != nil {
-		panic(err)
-	}
-	err = util.EnsureDirExists(globals.tmpDir)
-	if err != nil {
-		panic(err)
-	}
-
-	//TODO check errors on server settings
-	globals.server, err = config.GetString("server", "host")
-	globals.port, err = config.GetInt("server", "port")
-	globals.username, err = config.GetString("server", "username")
-	globals.password, err = config.GetString("server", "password")
-
-	//TODO check errors on encryption settings
-	globals.encrypted, err = config.GetBool("encryption", "enabled")
-	if globals.encrypted {
-		globals.key, err = config.GetString("encryption", "key")
-	}
-
-	globals.db, err = GetAndInitDB(config)
-	if err != nil {
-		panic(err)
+	if rehash {
+		for _, root := range roots {
+			err = root.db.DatabaseClearHashCache()
+			if err != nil {
+				panic(err)
+			}
+		}
 	}
 
-	//spawn goroutine to handle locking file paths
-	go PathLocker(globals.db)
-
-	//spawn goroutines to handle local events
-	go SendEvents(&globals)
-	localFileUpdates := make(chan *asink.Event)
-	initialWalkComplete := make(chan int)
-	go StartWatching(globals.syncDir, localFileUpdates, initialWalkComplete)
-
-	//spawn goroutines to receive remote events
-	remoteFileUpdates := make(chan *asink.Event)
-	go GetEvents(&globals, remoteFileUpdates)
-
+	//all the sync roots are controlled through the same socket
 	rpcTornDown := make(chan int)
-	go StartRPC(globals.rpcSock, rpcTornDown)
+	go StartRPC(rpcSock, rpcTornDown, roots)
 	defer func() { <-rpcTornDown }()
 
-	//make chan with which to wait for exit
-	exitChan := make(chan int)
-	asink.WaitOnExitChan(exitChan)
-
-	//create all the contexts
-	startupContext := NewStartupContext(&globals, localFileUpdates, remoteFileUpdates, initialWalkComplete, exitChan)
-	normalContext := NewNormalContext(&globals, localFileUpdates, remoteFileUpdates, exitChan)
-
-	//begin running contexts
-	err = startupContext.Run()
-	if err != nil && ErrorRequiresExit(err) {
-		fmt.Println(err)
-		if !ErrorWasExit(err) {
-			asink.Exit(1)
-		}
-		return
-	}
-
-	err = normalContext.Run()
-	if err != nil {
-		fmt.Println(err)
-		if !ErrorWasExit(err) {
-			asink.Exit(1)
-		}
+	//run each sync root until we exit. One which fails stops by itself,
+	//leaving the others running, unless it was the last one.
+	var wg sync.WaitGroup
+	var failedLock sync.Mutex
+	failed := 0
+	for _, root := range roots {
+		wg.Add(1)
+		go func(root *AsinkGlobals) {
+			defer wg.Done()
+			err := RunRoot(root)
+			if err == nil || ErrorWasExit(err) {
+				return
+			}
+			fmt.Println(root.name + ": " + err.Error() + " (no longer synchronizing)")
+			failedLock.Lock()
+			failed++
+			allFailed := failed == len(roots)
+			failedLock.Unlock()
+			if allFailed {
+				asink.Exit(1)
+			}
+		}(root)
 	}
+	wg.Wait()
 }
 
-func getSocketFromArgs(args []string) (string, error) {
+//Returns the RPC socket from the config file named in args, along with the
+//remaining (non-flag) arguments
+func getSocketFromArgs(args []string) (string, []string, error) {
 	const config_usage = "Config File to use"
 	userHomeDir := "~"
 
@@ -161,26 +152,27 @@ func getSocketFromArgs(args []string) (string, error) {
 		userHomeDir = u.HomeDir
 	}
 
+	var configFileName string
 	flags := flag.NewFlagSet("stop", flag.ExitOnError)
-	flags.StringVar(&globals.configFileName, "config", path.Join(userHomeDir, ".asink", "config"), config_usage)
-	flags.StringVar(&globals.configFileName, "c", path.Join(userHomeDir, ".asink", "config"), config_usage+" (shorthand)")
+	flags.StringVar(&configFileName, "config", path.Join(userHomeDir, ".asink", "config"), config_usage)
+	flags.StringVar(&configFileName, "c", path.Join(userHomeDir, ".asink", "config"), config_usage+" (shorthand)")
 	flags.Parse(args)
 
-	config, err := conf.ReadConfigFile(globals.configFileName)
+	config, err := conf.ReadConfigFile(configFileName)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	rpcSock, err := config.GetString("local", "socket")
 	if err != nil {
-		return "", errors.New("Error reading local.socket from config file at " + globals.configFileName)
+		return "", nil, errors.New("Error reading local.socket from config file at " + configFileName)
 	}
 
-	return rpcSock, nil
+	return rpcSock, flags.Args(), nil
 }
 
 func StopClient(args []string) {
-	rpcSock, err := getSocketFromArgs(args)
+	rpcSock, _, err := getSocketFromArgs(args)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -197,7 +189,7 @@ func StopClient(args []string) {
 func GetStatus(args []string) {
 	var status string
 
-	rpcSock, err := getSocketFromArgs(args)
+	rpcSock, _, err := getSocketFromArgs(args)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -211,3 +203,96 @@ func GetStatus(args []string) {
 
 	fmt.Println(status)
 }
+
+func GetHistory(args []string) {
+	var history string
+
+	rpcSock, paths, err := getSocketFromArgs(args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(paths) != 1 {
+		fmt.Println("Error: please supply the path of one file or directory")
+		return
+	}
+
+	//the client may have been started from a different directory
+	absolutePath, err := filepath.Abs(paths[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = asink.RPCCall(rpcSock, "ClientAdmin.GetHistory", &absolutePath, &history)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			fmt.Println("Error: " + err.Error())
+			return
+		}
+		panic(err)
+	}
+
+	fmt.Print(history)
+}
+
+func GetConflicts(args []string) {
+	var conflicts string
+
+	rpcSock, _, err := getSocketFromArgs(args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	i := 99
+	err = asink.RPCCall(rpcSock, "ClientAdmin.GetConflicts", &i, &conflicts)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			fmt.Println("Error: " + err.Error())
+			return
+		}
+		panic(err)
+	}
+
+	fmt.Print(conflicts)
+}
+
+func ResolveConflict(args []string) {
+	rpcSock, remaining, err := getSocketFromArgs(args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(remaining) < 2 || (remaining[1] == RESOLVE_MERGED) != (len(remaining) == 3) || len(remaining) > 3 {
+		fmt.Println("Usage: asink resolve /path/to/file local|remote|both")
+		fmt.Println("       asink resolve /path/to/file merged /path/to/merged/file")
+		return
+	}
+
+	//the client may have been started from a different directory
+	var resolveArgs ResolveConflictArgs
+	resolveArgs.Resolution = remaining[1]
+	resolveArgs.AbsolutePath, err = filepath.Abs(remaining[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(remaining) == 3 {
+		resolveArgs.MergedFile, err = filepath.Abs(remaining[2])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	i := 99
+	err = asink.RPCCall(rpcSock, "ClientAdmin.ResolveConflict", &resolveArgs, &i)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			fmt.Println("Error: " + err.Error())
+			return
+		}
+		panic(err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//A hybrid logical clock, which the client stamps its events with. It reads
+//as the wall clock time in nanoseconds, except that it never goes backwards
+//and is always ahead of the clocks of the events this client has seen, so a
+//change made after seeing another change is ordered after it even if this
+//machine's clock is behind the other one's.
+type HybridClock struct {
+	lock   sync.Mutex
+	latest int64
+}
+
+//Returns a clock which starts ahead of latest, the latest reading of the
+//clock (or any other) which has been saved
+func NewHybridClock(latest int64) *HybridClock {
+	c := new(HybridClock)
+	c.latest = latest
+	return c
+}
+
+//Returns a new reading, later than any the clock has given or seen before
+func (c *HybridClock) Now() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	physical := time.Now().UnixNano()
+	if physical > c.latest {
+		c.latest = physical
+	} else {
+		c.latest++
+	}
+	return c.latest
+}
+
+//Makes sure later readings are ahead of clock, the reading of an event
+//received from elsewhere
+func (c *HybridClock) Observe(clock int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if clock > c.latest {
+		c.latest = clock
+	}
+}
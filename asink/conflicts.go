@@ -0,0 +1,582 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aclindsa/asink"
+	"github.com/aclindsa/asink/util"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How conflicts between this client's version of a path and another client's
+//are settled
+const (
+	CONFLICT_KEEP_BOTH = "keepboth" //the remote version wins, and the local one is kept as a conflicted copy
+	CONFLICT_NEWEST    = "newest"   //whichever version was made last wins
+	CONFLICT_LOCAL     = "local"    //the local version wins
+	CONFLICT_REMOTE    = "remote"   //the remote version wins
+	CONFLICT_UPDATE    = "update"   //an update wins over a deletion, otherwise both are kept
+)
+
+//recorded as the policy of conflicts which were merged, or which couldn't be
+//merged cleanly and had both versions kept
+const CONFLICT_MERGE = "merge"
+
+//The default template for the names of conflicted copies
+const DEFAULT_CONFLICT_COPY_NAME = "{name}_conflicted_copy_{device}_{user}_{time}{ext}"
+
+//The fields which may be used in the names of conflicted copies: the name of
+//the original file without its extension, its extension (including the
+//'.'), the device and user the copied version came from, and when the copy
+//was made
+var conflictCopyFields = []string{"{name}", "{ext}", "{device}", "{user}", "{time}"}
+
+//how {time} is written, avoiding ':' since it isn't allowed in file names
+//on some systems
+const conflictCopyTimeFormat = "2006-01-02_15-04-05.000000"
+
+//characters which aren't allowed in file names on some systems or storage
+//backends
+const reservedFileNameChars = `<>:"/\|?*`
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case CONFLICT_KEEP_BOTH, CONFLICT_NEWEST, CONFLICT_LOCAL, CONFLICT_REMOTE, CONFLICT_UPDATE:
+		return true
+	}
+	return false
+}
+
+//Replaces the characters in name which aren't allowed in file names on some
+//systems
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(reservedFileNameChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+//Checks that template can be used to name conflicted copies: it must
+//include the original file's name along with something to tell the copy
+//apart from it, and mustn't contain any reserved characters
+func validConflictCopyName(template string) error {
+	if !strings.Contains(template, "{name}") {
+		return errors.New("Error: [conflicts] copyname must contain '{name}'")
+	}
+	literal := template
+	for _, field := range conflictCopyFields {
+		literal = strings.Replace(literal, field, "", -1)
+	}
+	if literal == "" {
+		return errors.New("Error: [conflicts] copyname must contain some text besides its fields, to tell conflicted copies apart from other files")
+	}
+	if sanitizeFileName(literal) != literal {
+		return errors.New("Error: [conflicts] copyname must not contain any of the characters " + reservedFileNameChars)
+	}
+	return nil
+}
+
+//Returns the name, according to template, of a conflicted copy of the file
+//named base, whose version came from the given device and user. If n is
+//greater than 1, it is added to the original name, to tell several copies
+//made at the same time apart.
+func conflictCopyName(template, base, device, user string, t time.Time, n int) string {
+	ext := path.Ext(base)
+	if ext == base {
+		//names like .bashrc have no extension
+		ext = ""
+	}
+	name := strings.TrimSuffix(base, ext)
+	if n > 1 {
+		name += "_" + strconv.Itoa(n)
+	}
+	if device = sanitizeFileName(device); device == "" {
+		device = "unknown"
+	}
+	if user = sanitizeFileName(user); user == "" {
+		user = "unknown"
+	}
+	replacer := strings.NewReplacer("{name}", name, "{ext}", ext, "{device}", device, "{user}", user, "{time}", t.Format(conflictCopyTimeFormat))
+	return replacer.Replace(template)
+}
+
+//Returns an ignore pattern matching the names of conflicted copies named
+//according to template
+func conflictCopyPattern(template string) string {
+	var buf bytes.Buffer
+	wildcard := false
+	for len(template) > 0 {
+		field := ""
+		for _, f := range conflictCopyFields {
+			if strings.HasPrefix(template, f) {
+				field = f
+				break
+			}
+		}
+		if field != "" {
+			//adjacent fields only need one wildcard between them
+			if !wildcard {
+				buf.WriteByte('*')
+			}
+			wildcard = true
+			template = template[len(field):]
+			continue
+		}
+		if strings.IndexByte("!#[\\", template[0]) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(template[0])
+		wildcard = false
+		template = template[1:]
+	}
+	return buf.String()
+}
+
+//A conflict which has been settled, as recorded in the database. Both
+//versions are kept in storage (unless the local one couldn't be uploaded), so
+//even those settled automatically can be revisited.
+type Conflict struct {
+	Id           int64
+	Path         string
+	LocalHash    string //"" if the local version deleted the path
+	LocalOnly    bool   //true if the local version lost and couldn't be uploaded, so it is only in this client's cache
+	RemoteHash   string //"" if the remote version deleted the path
+	RemoteUser   string
+	RemoteDevice string
+	Policy       string
+	LocalWon     bool
+	CopyPath     string //where the losing version was kept, relative to the sync directory, if it was
+	Timestamp    int64  //when the conflict was settled, in nanoseconds since the epoch
+	Resolved     bool   //false until someone has decided which version to keep, if the policy didn't
+}
+
+type conflictRule struct {
+	pattern *ignorePattern
+	policy  string
+}
+
+//The conflict policy used for each path: the default, unless it matches one
+//of the rules, of which the last to match wins. Rules use the same patterns
+//as the ignore list, and apply to everything inside the directories they
+//match, as do the patterns of the text files which are merged.
+type ConflictPolicies struct {
+	defaultPolicy string
+	rules         []conflictRule
+	merge         []*ignorePattern
+}
+
+//rules are of the form 'pattern:policy'
+func NewConflictPolicies(defaultPolicy string, rules []string, merge []string) (*ConflictPolicies, error) {
+	if !validConflictPolicy(defaultPolicy) {
+		return nil, errors.New("Error: [conflicts] policy must be one of '" + CONFLICT_KEEP_BOTH + "', '" + CONFLICT_NEWEST + "', '" + CONFLICT_LOCAL + "', '" + CONFLICT_REMOTE + "', or '" + CONFLICT_UPDATE + "'")
+	}
+	cp := &ConflictPolicies{defaultPolicy: defaultPolicy}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.LastIndex(rule, ":")
+		if i < 0 || !validConflictPolicy(strings.TrimSpace(rule[i+1:])) {
+			return nil, errors.New("Error: [conflicts] rules must be of the form 'pattern:policy', with a valid policy ('" + rule + "')")
+		}
+		pattern := parseIgnorePattern(rule[:i])
+		if pattern == nil || pattern.negate {
+			return nil, errors.New("Error: invalid pattern in [conflicts] rules ('" + rule + "')")
+		}
+		cp.rules = append(cp.rules, conflictRule{pattern, strings.TrimSpace(rule[i+1:])})
+	}
+	for _, p := range merge {
+		if pattern := parseIgnorePattern(p); pattern != nil && !pattern.negate {
+			cp.merge = append(cp.merge, pattern)
+		}
+	}
+	return cp, nil
+}
+
+//returns true if p or one of its parent directories matches pattern
+func matchesPathOrParent(pattern *ignorePattern, relPath string, isDir bool) bool {
+	for p, dir := relPath, isDir; p != "." && p != "/" && p != ""; p, dir = path.Dir(p), true {
+		if pattern.matches(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the policy for relPath, which is relative to the sync directory
+func (cp *ConflictPolicies) PolicyFor(relPath string, isDir bool) string {
+	policy := cp.defaultPolicy
+	for _, rule := range cp.rules {
+		if matchesPathOrParent(rule.pattern, relPath, isDir) {
+			policy = rule.policy
+		}
+	}
+	return policy
+}
+
+//Returns true if conflicting versions of the file at relPath should be
+//merged
+func (cp *ConflictPolicies) Mergeable(relPath string) bool {
+	for _, pattern := range cp.merge {
+		if matchesPathOrParent(pattern, relPath, false) {
+			return true
+		}
+	}
+	return false
+}
+
+//Settles a conflict between local, this client's version of a path, and
+//remote, the version on the server, according to the path's policy. The
+//conflict is recorded, and if the local version loses and the policy says to
+//keep it, it is copied (from copyFrom) to a conflicted copy. Returns true if
+//the local version should win.
+//
+//Text files matching the merge patterns are merged instead. If this merges
+//them cleanly, the hash of the merged version (which is left in the cache) is
+//also returned, and should win in place of the local version. Otherwise, both
+//are kept, with the conflicted copy showing where they differ.
+func settleConflict(globals *AsinkGlobals, local, remote *asink.Event, copyFrom string) (bool, string, error) {
+	policy := globals.conflicts.PolicyFor(local.Path, local.IsDirectory())
+	merged, clean := "", false
+	if globals.conflicts.Mergeable(local.Path) && canMerge(local, remote) {
+		var err error
+		merged, clean, err = mergeVersions(globals, local, remote, copyFrom)
+		if err != nil {
+			fmt.Println("Warning: unable to merge the conflicting versions of " + local.Path + ": " + err.Error())
+		} else {
+			policy = CONFLICT_MERGE
+		}
+	}
+
+	localWins, keepBoth := false, false
+	switch policy {
+	case CONFLICT_MERGE:
+		if clean {
+			localWins = true
+		} else {
+			keepBoth = true
+			copyFrom = path.Join(globals.cacheDir, merged)
+		}
+	case CONFLICT_KEEP_BOTH:
+		keepBoth = true
+	case CONFLICT_NEWEST:
+		localWins = remote.Before(local)
+	case CONFLICT_LOCAL:
+		localWins = true
+	case CONFLICT_UPDATE:
+		if local.IsDelete() == remote.IsDelete() {
+			keepBoth = true
+		} else {
+			localWins = remote.IsDelete()
+		}
+	}
+
+	//members with read-only access can't make their version win, so
+	//theirs is kept rather than lost
+	if localWins && globals.stats.ReadOnly() {
+		localWins, keepBoth = false, true
+	}
+
+	conflict := &Conflict{
+		Path:         local.Path,
+		RemoteUser:   remote.Username,
+		RemoteDevice: remote.Device,
+		Policy:       policy,
+		LocalWon:     localWins,
+		Timestamp:    time.Now().UnixNano(),
+		Resolved:     true,
+	}
+	if local.IsUpdate() {
+		conflict.LocalHash = local.Hash
+	}
+
+	//a losing local version the server never accepted hasn't necessarily
+	//been uploaded, so upload it now so it can still be revisited
+	if !localWins && local.IsUpdate() && !local.IsDirectory() && !local.IsSymlink() && local.Id == 0 {
+		if globals.stats.ReadOnly() {
+			conflict.LocalOnly = true
+		} else if err := uploadEvent(globals, local); err != nil {
+			fmt.Println("Warning: unable to upload the losing local version of " + local.Path + ": " + err.Error())
+			conflict.LocalOnly = true
+		}
+	}
+	if remote.IsUpdate() {
+		conflict.RemoteHash = remote.Hash
+	}
+
+	if keepBoth {
+		copyPath, err := handleConflict(globals, local, copyFrom)
+		if err != nil {
+			return false, "", err
+		}
+		if copyPath != "" {
+			conflict.CopyPath = copyPath
+			conflict.Resolved = false
+		}
+	}
+
+	err := globals.db.DatabaseAddConflict(conflict)
+	if err != nil {
+		return false, "", err
+	}
+	if !localWins || !clean {
+		merged = ""
+	}
+	return localWins, merged, nil
+}
+
+//Puts the local version of event's path back in place after it won a
+//conflict with a remote version which had already replaced it
+func restoreLocalVersion(globals *AsinkGlobals, event *asink.Event) error {
+	absolutePath := path.Join(globals.syncDir, event.Path)
+	if event.IsDelete() {
+		if !event.IsDirectory() {
+			//intentionally ignore errors in case it is already gone
+			os.Remove(absolutePath)
+		}
+		return nil
+	}
+	if event.IsDirectory() || event.IsSymlink() {
+		return nil
+	}
+
+	err := replaceFile(globals, path.Join(globals.cacheDir, event.Hash), absolutePath, event.Permissions)
+	if err != nil {
+		return err
+	}
+	return updateHashCache(globals, event, absolutePath)
+}
+
+//Replaces the file at absolutePath with a copy of source
+func replaceFile(globals *AsinkGlobals, source, absolutePath string, permissions os.FileMode) error {
+	tmpfilename, err := util.CopyToTmp(source, globals.tmpDir)
+	if err != nil {
+		return err
+	}
+	err = util.EnsureDirExists(path.Dir(absolutePath))
+	if err != nil {
+		os.Remove(tmpfilename)
+		return err
+	}
+	err = os.Rename(tmpfilename, absolutePath)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return err
+	}
+	return os.Chmod(absolutePath, permissions)
+}
+
+//Ways of resolving a conflict which kept both versions
+const (
+	RESOLVE_LOCAL  = "local"  //keep the local version, which was kept as the conflicted copy
+	RESOLVE_REMOTE = "remote" //keep the remote version, which is in place
+	RESOLVE_BOTH   = "both"   //keep both, leaving the conflicted copy as a separate file
+	RESOLVE_MERGED = "merged" //replace both with a file merging them
+)
+
+//Resolves the latest unresolved conflict for relPath. Whichever version is
+//kept (or the merged file, for RESOLVE_MERGED) is put in place and sent to
+//the server as a change to the version which won the conflict, so other
+//computers settle on it too (unless it is the remote version, and is already
+//in place), and the conflicted copy is removed unless both are kept.
+func resolveConflict(globals *AsinkGlobals, relPath, resolution, mergedFile string) error {
+	conflict, err := globals.db.DatabaseGetUnresolvedConflict(relPath)
+	if err != nil {
+		return err
+	}
+	if conflict == nil {
+		return errors.New("There is no unresolved conflict for " + path.Join(globals.syncDir, relPath))
+	}
+	if globals.stats.ReadOnly() {
+		return errors.New("Conflicts can't be resolved with read-only access to share '" + globals.share + "'")
+	}
+
+	//make sure nothing else changes the file while we replace it. Unless
+	//the resolution is sent, the path is unlocked without changing it.
+	latest := globals.locker.LockPath(relPath, true)
+	unchanged := new(asink.Event)
+	unchanged.Path = relPath
+	unchanged.LocalStatus = asink.DISCARDED
+	unlockWith := unchanged
+	defer func() { globals.locker.UnlockPath(unlockWith) }()
+
+	copyPath := path.Join(globals.syncDir, conflict.CopyPath)
+	permissions := os.FileMode(0644)
+	if latest != nil && latest.IsUpdate() {
+		permissions = latest.Permissions
+	}
+
+	//the hash of the version to keep, "" to keep the path deleted
+	keep := conflict.RemoteHash
+	switch resolution {
+	case RESOLVE_LOCAL:
+		keep = conflict.LocalHash
+		if _, err := os.Stat(path.Join(globals.cacheDir, keep)); keep != "" && err != nil {
+			keep, err = cacheFile(globals, copyPath)
+			if err != nil {
+				return err
+			}
+		}
+	case RESOLVE_MERGED:
+		if mergedFile == "" {
+			return errors.New("Please supply the merged file")
+		}
+		keep, err = cacheFile(globals, mergedFile)
+		if err != nil {
+			return err
+		}
+	case RESOLVE_REMOTE, RESOLVE_BOTH:
+	default:
+		return errors.New("Conflicts must be resolved with one of '" + RESOLVE_LOCAL + "', '" + RESOLVE_REMOTE + "', '" + RESOLVE_BOTH + "', or '" + RESOLVE_MERGED + "'")
+	}
+
+	//if the remote version is kept and nothing has changed it here since,
+	//it is already in place and on the server, so there is nothing to send
+	inPlace := keep == conflict.RemoteHash && !conflict.LocalWon && latest != nil && latest.IsDelete() == (keep == "") && latest.Hash == keep
+	if !inPlace {
+		resolved, err := sendResolution(globals, conflict, latest, keep, permissions)
+		if resolved != nil {
+			unlockWith = resolved
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if resolution != RESOLVE_BOTH && conflict.CopyPath != "" {
+		err = os.Remove(copyPath)
+		if err != nil && !util.ErrorFileNotFound(err) {
+			return err
+		}
+	}
+	return globals.db.DatabaseResolveConflict(conflict.Id)
+}
+
+//Sends keep, the hash of the version a conflict was resolved with ("" to
+//delete the path), to the server as a change to the version which won the
+//conflict, and puts it in place once the server has accepted it. The event
+//sent is returned if it was accepted, even if putting it in place failed.
+func sendResolution(globals *AsinkGlobals, conflict *Conflict, latest *asink.Event, keep string, permissions os.FileMode) (*asink.Event, error) {
+	absolutePath := path.Join(globals.syncDir, conflict.Path)
+	resolved := new(asink.Event)
+	resolved.Path = conflict.Path
+	resolved.Predecessor = conflict.RemoteHash
+	if conflict.LocalWon {
+		resolved.Predecessor = conflict.LocalHash
+	}
+	if keep == "" {
+		resolved.Type = asink.DELETE
+	} else {
+		resolved.Type = asink.UPDATE
+		resolved.Hash = keep
+		resolved.Permissions = permissions
+		resolved.MTime = time.Now().UnixNano()
+		if latest != nil && latest.IsUpdate() && latest.Hash == keep {
+			//the version kept is already in place, so keep its mtime
+			resolved.MTime = latest.MTime
+		} else if keep != conflict.RemoteHash {
+			err := uploadEvent(globals, resolved)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	resolved.Timestamp = time.Now().UnixNano()
+	resolved.Clock = globals.clock.Now()
+
+	globals.stats.StartSending()
+	err := SendEvent(globals, resolved)
+	globals.stats.StopSending()
+	if _, ok := err.(EventConflictError); ok {
+		return nil, errors.New(absolutePath + " has been changed again since the conflict, please resolve it again")
+	} else if err != nil {
+		return nil, err
+	}
+
+	//only change the file once the server has accepted the resolution
+	if keep == "" {
+		//intentionally ignore errors in case it is already gone
+		os.Remove(absolutePath)
+		return resolved, nil
+	}
+	if latest == nil || latest.Hash != keep {
+		err = replaceFile(globals, path.Join(globals.cacheDir, keep), absolutePath, permissions)
+		if err != nil {
+			return resolved, err
+		}
+	}
+	mtime := time.Unix(0, resolved.MTime)
+	err = os.Chtimes(absolutePath, mtime, mtime)
+	if err != nil {
+		return resolved, err
+	}
+	return resolved, updateHashCache(globals, resolved, absolutePath)
+}
+
+//Copies source into the cache, returning its hash
+func cacheFile(globals *AsinkGlobals, source string) (string, error) {
+	tmpfilename, err := util.CopyToTmp(source, globals.tmpDir)
+	if err != nil {
+		return "", err
+	}
+	hash, err := HashFile(tmpfilename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return "", err
+	}
+	err = os.Rename(tmpfilename, path.Join(globals.cacheDir, hash))
+	if err != nil {
+		os.Remove(tmpfilename)
+		return "", err
+	}
+	return hash, nil
+}
+
+//Describes each of conflicts, saying which versions were involved and where
+//the local one was kept
+func FormatConflicts(globals *AsinkGlobals, conflicts []*Conflict) string {
+	result := ""
+	for _, conflict := range conflicts {
+		result += path.Join(globals.syncDir, conflict.Path) + "\n"
+		result += "  at " + time.Unix(0, conflict.Timestamp).Format("2006-01-02 15:04:05") + "\n"
+		result += "  local:  " + describeVersion(conflict.LocalHash)
+		if conflict.LocalOnly {
+			result += " (only on this device)"
+		}
+		if conflict.CopyPath != "" {
+			result += ", kept as " + path.Join(globals.syncDir, conflict.CopyPath)
+		}
+		result += "\n"
+		result += "  remote: " + describeVersion(conflict.RemoteHash)
+		if conflict.RemoteUser != "" {
+			result += " by " + conflict.RemoteUser
+		}
+		if conflict.RemoteDevice != "" {
+			result += " on " + conflict.RemoteDevice
+		}
+		result += "\n"
+	}
+	return result
+}
+
+func describeVersion(hash string) string {
+	if hash == "" {
+		return "deleted"
+	}
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return hash
+}
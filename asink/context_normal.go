@@ -33,36 +33,14 @@ func (nc *NormalContext) runWorker() {
 		select {
 		case event := <-nc.localUpdatesChan:
 			//process top half of local event
-			err := ProcessLocalEvent(nc.globals, event)
+			err := processWithRetry(nc.globals, event, ProcessLocalEvent)
 			if err != nil {
-				if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-					nc.workerError <- err
-					continue
-				} else {
-					//if error was temporary, retry once
-					event.LocalStatus = 0
-					err := ProcessLocalEvent(nc.globals, event)
-					if err != nil {
-						nc.workerError <- err
-						continue
-					}
-				}
+				nc.workerError <- err
 			}
 		case event := <-nc.remoteUpdatesChan:
-			err := ProcessRemoteEvent(nc.globals, event)
+			err := processWithRetry(nc.globals, event, ProcessRemoteEvent)
 			if err != nil {
-				if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-					nc.workerError <- err
-					continue
-				} else {
-					//if error was temporary, retry once
-					event.LocalStatus = 0
-					err := ProcessRemoteEvent(nc.globals, event)
-					if err != nil {
-						nc.workerError <- err
-						continue
-					}
-				}
+				nc.workerError <- err
 			}
 		case <-nc.workerExit:
 			return
@@ -5,26 +5,32 @@
 package main
 
 import (
+	"fmt"
 	"github.com/aclindsa/asink"
-	"os"
-	"path"
+	"strconv"
 	"time"
 )
 
+//the name under which the id of the snapshot a sync root started from is
+//stored in its database
+const SNAPSHOT_STATE = "snapshot"
+
 type StartupContext struct {
 	globals             *AsinkGlobals
 	localUpdatesChan    chan *asink.Event
 	remoteUpdatesChan   chan *asink.Event
 	initialWalkComplete chan int
+	snapshotApplied     chan int
 	exitChan            chan int
 }
 
-func NewStartupContext(globals *AsinkGlobals, localChan chan *asink.Event, remoteChan chan *asink.Event, initialWalkComplete chan int, exitChan chan int) *StartupContext {
+func NewStartupContext(globals *AsinkGlobals, localChan chan *asink.Event, remoteChan chan *asink.Event, initialWalkComplete chan int, snapshotApplied chan int, exitChan chan int) *StartupContext {
 	sc := new(StartupContext)
 	sc.globals = globals
 	sc.localUpdatesChan = localChan
 	sc.remoteUpdatesChan = remoteChan
 	sc.initialWalkComplete = initialWalkComplete
+	sc.snapshotApplied = snapshotApplied
 	sc.exitChan = exitChan
 	return sc
 }
@@ -32,26 +38,15 @@ func NewStartupContext(globals *AsinkGlobals, localChan chan *asink.Event, remot
 func (sc *StartupContext) Run() error {
 	//process top halves of local updates so the files are saved off at least locally
 	localEvents := []*asink.Event{}
+	var err error
 	initialWalkIncomplete := true
 	for initialWalkIncomplete {
 		select {
 		case event := <-sc.localUpdatesChan:
 			//process top half of local event
-			err := ProcessLocalEvent_Upper(sc.globals, event)
+			localEvents, err = sc.processLocalUpper(event, localEvents)
 			if err != nil {
-				if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-					return err
-				} else {
-					//if error was temporary, retry once
-					event.LocalStatus = 0
-					err := ProcessLocalEvent_Upper(sc.globals, event)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			if event.LocalStatus&asink.DISCARDED == 0 {
-				localEvents = append(localEvents, event)
+				return err
 			}
 		case <-sc.initialWalkComplete:
 			initialWalkIncomplete = false
@@ -60,34 +55,26 @@ func (sc *StartupContext) Run() error {
 		}
 	}
 
-	//find any files that have been deleted since the last time we ran
-	deletedFiles := []*asink.Event{}
-	resultChan := make(chan *asink.Event)
-	errorChan := make(chan error)
-	go sc.globals.db.DatabaseGetAllFiles(resultChan, errorChan)
-	deletionWalkIncomplete := true
-	for deletionWalkIncomplete {
-		select {
-		case oldEvent := <-resultChan:
-			if oldEvent == nil {
-				deletionWalkIncomplete = false
-				break
-			}
+	//a new sync root starts from the current state of the share, rather
+	//than replaying its whole history
+	localEvents, err = sc.bootstrap(localEvents)
+	if err != nil {
+		return err
+	}
+	close(sc.snapshotApplied)
 
-			//if the file still exists, disregard this event
-			absolutePath := path.Join(sc.globals.syncDir, oldEvent.Path)
-			if _, err := os.Stat(absolutePath); err == nil {
-				break
-			}
+	//download or remove files whose subtrees were selected or deselected
+	//since the last time we ran (this must happen before looking for
+	//deleted files, or the newly-selected ones would appear deleted)
+	err = ApplySelection(sc.globals)
+	if err != nil {
+		return err
+	}
 
-			event := new(asink.Event)
-			event.Path = absolutePath
-			event.Type = asink.DELETE
-			event.Timestamp = time.Now().UnixNano()
-			deletedFiles = append(deletedFiles, event)
-		case err := <-errorChan:
-			return ProcessingError{PERMANENT, err}
-		}
+	//find any files that have been deleted since the last time we ran
+	deletedFiles, err := FindDeletedFiles(sc.globals)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
 	}
 
 	for _, event := range deletedFiles {
@@ -98,21 +85,9 @@ func (sc *StartupContext) Run() error {
 		default:
 		}
 		//process top half of local event
-		err := ProcessLocalEvent_Upper(sc.globals, event)
+		localEvents, err = sc.processLocalUpper(event, localEvents)
 		if err != nil {
-			if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-				return err
-			} else {
-				//if error was temporary, retry once
-				event.LocalStatus = 0
-				err := ProcessLocalEvent_Upper(sc.globals, event)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		if event.LocalStatus&asink.DISCARDED == 0 {
-			localEvents = append(localEvents, event)
+			return err
 		}
 	}
 
@@ -123,36 +98,15 @@ func (sc *StartupContext) Run() error {
 		select {
 		case event := <-sc.localUpdatesChan:
 			//process top half of local event
-			err := ProcessLocalEvent_Upper(sc.globals, event)
+			localEvents, err = sc.processLocalUpper(event, localEvents)
 			if err != nil {
-				if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-					return err
-				} else {
-					//if error was temporary, retry once
-					event.LocalStatus = 0
-					err := ProcessLocalEvent_Upper(sc.globals, event)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			if event.LocalStatus&asink.DISCARDED == 0 {
-				localEvents = append(localEvents, event)
+				return err
 			}
 			timeout.Reset(1 * time.Second)
 		case event := <-sc.remoteUpdatesChan:
-			err := ProcessRemoteEvent(sc.globals, event)
+			err := processWithRetry(sc.globals, event, ProcessRemoteEvent)
 			if err != nil {
-				if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-					return err
-				} else {
-					//if error was temporary, retry once
-					event.LocalStatus = 0
-					err := ProcessRemoteEvent(sc.globals, event)
-					if err != nil {
-						return err
-					}
-				}
+				return err
 			}
 			timeout.Reset(1 * time.Second)
 		case <-timeout.C:
@@ -169,21 +123,123 @@ func (sc *StartupContext) Run() error {
 			return ProcessingError{EXITED, nil}
 		default:
 		}
-		err := ProcessLocalEvent_Lower(sc.globals, event)
+		err := processWithRetry(sc.globals, event, ProcessLocalEvent_Lower)
 		if err != nil {
-			if e, ok := err.(ProcessingError); !ok || e.ErrorType != TEMPORARY {
-				return err
-			} else {
-				//if error was temporary, retry once
-				event.LocalStatus = 0
-				err := ProcessLocalEvent_Lower(sc.globals, event)
+			return err
+		}
+	}
+
+	//finally, process the bottom halves of local updates
+	return nil
+}
+
+//Returns the id of the snapshot this sync root was started from, or 0 if it
+//wasn't started from one
+func SnapshotId(globals *AsinkGlobals) (int64, error) {
+	value, err := globals.db.DatabaseGetState(SNAPSHOT_STATE)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+//If we have never received any events from the server, ask it for a snapshot
+//of the latest version of each file, and apply them. GetEvents() then
+//continues from the event the snapshot was taken as of, so intermediate
+//versions are never downloaded. Local events arriving in the meantime have
+//their top halves processed, and are appended to localEvents.
+func (sc *StartupContext) bootstrap(localEvents []*asink.Event) ([]*asink.Event, error) {
+	latestEvent, err := sc.globals.db.DatabaseLatestRemoteEvent()
+	if err != nil {
+		return localEvents, ProcessingError{PERMANENT, err}
+	}
+	state, err := sc.globals.db.DatabaseGetState(SNAPSHOT_STATE)
+	if err != nil {
+		return localEvents, ProcessingError{PERMANENT, err}
+	}
+	if latestEvent != nil || state != "" {
+		return localEvents, nil
+	}
+
+	var asOf int64
+	var after string
+	var successiveErrors uint = 0
+	for {
+		page, err := GetSnapshot(sc.globals, asOf, after)
+		if err == SnapshotUnsupportedErr {
+			fmt.Println(sc.globals.name + ": " + err.Error() + ", replaying all events instead")
+			return localEvents, nil
+		} else if e, ok := err.(ProcessingError); ok && e.ErrorType == CONFIG {
+			return localEvents, err
+		} else if err != nil {
+			//wait before retrying, handling local events in the meantime
+			sc.globals.stats.Offline()
+			fmt.Println(err)
+			var waitMilliseconds time.Duration = MIN_ERROR_WAIT << successiveErrors
+			if waitMilliseconds > MAX_ERROR_WAIT {
+				waitMilliseconds = MAX_ERROR_WAIT
+			}
+			successiveErrors++
+			wait := time.After(waitMilliseconds * time.Millisecond)
+			for waiting := true; waiting; {
+				select {
+				case event := <-sc.localUpdatesChan:
+					localEvents, err = sc.processLocalUpper(event, localEvents)
+					if err != nil {
+						return localEvents, err
+					}
+				case <-wait:
+					waiting = false
+				case <-sc.exitChan:
+					return localEvents, ProcessingError{EXITED, nil}
+				}
+			}
+			continue
+		}
+		sc.globals.stats.Online()
+		successiveErrors = 0
+
+		asOf = page.AsOf
+		if len(page.Events) == 0 {
+			break
+		}
+		after = page.Events[len(page.Events)-1].Path
+
+		for _, event := range page.Events {
+			select {
+			case local := <-sc.localUpdatesChan:
+				localEvents, err = sc.processLocalUpper(local, localEvents)
 				if err != nil {
-					return err
+					return localEvents, err
 				}
+			case <-sc.exitChan:
+				return localEvents, ProcessingError{EXITED, nil}
+			default:
+			}
+
+			err := processWithRetry(sc.globals, event, ProcessRemoteEvent)
+			if err != nil {
+				return localEvents, err
 			}
 		}
 	}
 
-	//finally, process the bottom halves of local updates
-	return nil
+	err = sc.globals.db.DatabaseSetState(SNAPSHOT_STATE, strconv.FormatInt(asOf, 10))
+	if err != nil {
+		return localEvents, ProcessingError{PERMANENT, err}
+	}
+	return localEvents, nil
+}
+
+//processes the top half of a local event, appending it to localEvents unless
+//it was discarded
+func (sc *StartupContext) processLocalUpper(event *asink.Event, localEvents []*asink.Event) ([]*asink.Event, error) {
+	err := processWithRetry(sc.globals, event, ProcessLocalEvent_Upper)
+	if err != nil {
+		return localEvents, err
+	}
+	if event.LocalStatus&asink.DISCARDED == 0 {
+		localEvents = append(localEvents, event)
+	}
+	return localEvents, nil
 }
@@ -5,13 +5,15 @@
 package main
 
 import (
-	"code.google.com/p/goconf/conf"
 	"database/sql"
 	"errors"
 	"github.com/aclindsa/asink"
+	"github.com/aclindsa/asink/util"
 	_ "github.com/mattn/go-sqlite3"
 	"strconv"
+	"strings"
 	"sync"
+	"unicode/utf8"
 )
 
 type AsinkDB struct {
@@ -19,7 +21,43 @@ type AsinkDB struct {
 	lock sync.Mutex
 }
 
-func GetAndInitDB(config *conf.ConfigFile) (*AsinkDB, error) {
+//The columns of the events table, in the order expected by scanEvent()
+const eventColumns = "id, localid, type, localstatus, path, hash, predecessor, timestamp, permissions, sourcepath, linktarget, mtime, xattrs, uuid, username, device, clock"
+
+//columns added to the events table since it was first created, and their
+//definitions
+var eventColumnUpgrades = [][2]string{
+	{"sourcepath", "TEXT NOT NULL DEFAULT ''"},
+	{"linktarget", "TEXT NOT NULL DEFAULT ''"},
+	{"mtime", "INTEGER NOT NULL DEFAULT 0"},
+	{"xattrs", "TEXT NOT NULL DEFAULT ''"},
+	{"uuid", "TEXT NOT NULL DEFAULT ''"},
+	{"username", "TEXT NOT NULL DEFAULT ''"},
+	{"device", "TEXT NOT NULL DEFAULT ''"},
+	{"clock", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+//eventColumns prefixed by a table alias, for use in joins
+func eventColumnsAs(alias string) string {
+	return alias + "." + strings.Replace(eventColumns, ", ", ", "+alias+".", -1)
+}
+
+//satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner) (*asink.Event, error) {
+	event := new(asink.Event)
+	err := row.Scan(&event.Id, &event.LocalId, &event.Type, &event.LocalStatus, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions, &event.SourcePath, &event.LinkTarget, &event.MTime, &event.Xattrs, &event.UUID, &event.Username, &event.Device, &event.Clock)
+	if err != nil {
+		return nil, err
+	}
+	event.InDB = true
+	return event, nil
+}
+
+func GetAndInitDB(config *RootConfig) (*AsinkDB, error) {
 	dbLocation, err := config.GetString("local", "dblocation")
 	if err != nil {
 		return nil, errors.New("Error: database location not specified in config file.")
@@ -45,7 +83,70 @@ func GetAndInitDB(config *conf.ConfigFile) (*AsinkDB, error) {
 		//		tx.Exec("CREATE INDEX IF NOT EXISTS localididx on events (localid)")
 		tx.Exec("CREATE INDEX IF NOT EXISTS ididx on events (id);")
 		tx.Exec("CREATE INDEX IF NOT EXISTS pathidx on events (path);")
+	} else {
+		rows.Close()
+	}
+
+	//upgrade events tables created by previous versions
+	for _, column := range eventColumnUpgrades {
+		err = util.EnsureColumnExists(tx, "events", column[0], column[1])
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	//events saved before they had clocks are ordered by their timestamps,
+	//as they were before
+	_, err = tx.Exec("UPDATE events SET clock = timestamp WHERE clock = 0;")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	//make sure the hash cache table is created
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='hashcache';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE hashcache (path TEXT PRIMARY KEY, device INTEGER, inode INTEGER, size INTEGER, mtime INTEGER, ctime INTEGER, hash TEXT);")
+	} else {
+		rows.Close()
+	}
+	tx.Exec("CREATE INDEX IF NOT EXISTS hashcacheinodeidx on hashcache (device, inode);")
+
+	//make sure the table of settled conflicts is created
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='conflicts';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE conflicts (id INTEGER PRIMARY KEY ASC, path TEXT, localhash TEXT, remotehash TEXT, remoteuser TEXT, remotedevice TEXT, policy TEXT, localwon INTEGER, copypath TEXT, timestamp INTEGER, resolved INTEGER);")
+		tx.Exec("CREATE INDEX IF NOT EXISTS conflictresolvedidx on conflicts (resolved);")
+	} else {
+		rows.Close()
+	}
+	err = util.EnsureColumnExists(tx, "conflicts", "localonly", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	//make sure the table of miscellaneous synchronization state is created
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='state';")
+	if err != nil {
+		return nil, err
 	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE state (name TEXT PRIMARY KEY, value TEXT);")
+	} else {
+		rows.Close()
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return nil, err
@@ -70,7 +171,7 @@ func (adb *AsinkDB) DatabaseAddEvent(e *asink.Event) (err error) {
 		adb.lock.Unlock()
 	}()
 
-	result, err := tx.Exec("INSERT INTO events (id, type, localstatus, path, hash, predecessor, timestamp, permissions) VALUES (?,?,?,?,?,?,?,?);", e.Id, e.Type, e.LocalStatus, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions)
+	result, err := tx.Exec("INSERT INTO events (id, type, localstatus, path, hash, predecessor, timestamp, permissions, sourcepath, linktarget, mtime, xattrs, uuid, username, device, clock) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);", e.Id, e.Type, e.LocalStatus, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions, e.SourcePath, e.LinkTarget, e.MTime, e.Xattrs, e.UUID, e.Username, e.Device, e.Clock)
 	if err != nil {
 		return err
 	}
@@ -88,6 +189,44 @@ func (adb *AsinkDB) DatabaseAddEvent(e *asink.Event) (err error) {
 	return nil
 }
 
+//adds several events in a single transaction
+func (adb *AsinkDB) DatabaseAddEvents(events []*asink.Event) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		result, err := tx.Exec("INSERT INTO events (id, type, localstatus, path, hash, predecessor, timestamp, permissions, sourcepath, linktarget, mtime, xattrs, uuid, username, device, clock) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);", e.Id, e.Type, e.LocalStatus, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions, e.SourcePath, e.LinkTarget, e.MTime, e.Xattrs, e.UUID, e.Username, e.Device, e.Clock)
+		if err != nil {
+			return err
+		}
+		ids[i], err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for i, e := range events {
+		e.LocalId = ids[i]
+		e.InDB = true
+	}
+	return nil
+}
+
 func (adb *AsinkDB) DatabaseUpdateEvent(e *asink.Event) (err error) {
 	if !e.InDB {
 		return errors.New("Attempting to update an event in the database which hasn't been previously added.")
@@ -106,7 +245,7 @@ func (adb *AsinkDB) DatabaseUpdateEvent(e *asink.Event) (err error) {
 		adb.lock.Unlock()
 	}()
 
-	result, err := tx.Exec("UPDATE events SET id=?, type=?, localstatus=?, path=?, hash=?, predecessor=?, timestamp=?, permissions=? WHERE localid == ?;", e.Id, e.Type, e.LocalStatus, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions, e.LocalId)
+	result, err := tx.Exec("UPDATE events SET id=?, type=?, localstatus=?, path=?, hash=?, predecessor=?, timestamp=?, permissions=?, sourcepath=?, linktarget=?, mtime=?, xattrs=?, uuid=?, username=?, device=?, clock=? WHERE localid == ?;", e.Id, e.Type, e.LocalStatus, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions, e.SourcePath, e.LinkTarget, e.MTime, e.Xattrs, e.UUID, e.Username, e.Device, e.Clock, e.LocalId)
 	if err != nil {
 		return err
 	}
@@ -131,10 +270,9 @@ func (adb *AsinkDB) DatabaseLatestEventForPath(path string) (event *asink.Event,
 	//make sure the database gets unlocked
 	defer adb.lock.Unlock()
 
-	row := adb.db.QueryRow("SELECT id, localid, type, localstatus, path, hash, predecessor, timestamp, permissions FROM events WHERE path == ? ORDER BY timestamp DESC LIMIT 1;", path)
+	row := adb.db.QueryRow("SELECT "+eventColumns+" FROM events WHERE path == ? ORDER BY clock DESC, localid DESC LIMIT 1;", path)
 
-	event = new(asink.Event)
-	err = row.Scan(&event.Id, &event.LocalId, &event.Type, &event.LocalStatus, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions)
+	event, err = scanEvent(row)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -146,16 +284,17 @@ func (adb *AsinkDB) DatabaseLatestEventForPath(path string) (event *asink.Event,
 	}
 }
 
-//returns nil if no such event exists
+//Returns the event with the highest id we have received from the server, or
+//nil if no such event exists. Our own events which haven't come back from the
+//server yet don't count, since events before them may not have either.
 func (adb *AsinkDB) DatabaseLatestRemoteEvent() (event *asink.Event, err error) {
 	adb.lock.Lock()
 	//make sure the database gets unlocked
 	defer adb.lock.Unlock()
 
-	row := adb.db.QueryRow("SELECT id, localid, type, localstatus, path, hash, predecessor, timestamp, permissions FROM events WHERE id > 0 ORDER BY id DESC LIMIT 1;")
+	row := adb.db.QueryRow("SELECT "+eventColumns+" FROM events WHERE id > 0 AND (localstatus & ?) == 0 ORDER BY id DESC LIMIT 1;", asink.SENT)
 
-	event = new(asink.Event)
-	err = row.Scan(&event.Id, &event.LocalId, &event.Type, &event.LocalStatus, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions)
+	event, err = scanEvent(row)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -167,7 +306,19 @@ func (adb *AsinkDB) DatabaseLatestRemoteEvent() (event *asink.Event, err error)
 	}
 }
 
-//Sends events down resultsChan for all files currently tracked in the
+//Returns the latest clock reading of any event we know about, so the clock
+//keeps going forwards after the client restarts
+func (adb *AsinkDB) DatabaseLatestClock() (clock int64, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT COALESCE(MAX(clock), 0) FROM events;")
+	err = row.Scan(&clock)
+	return clock, err
+}
+
+//Sends events down resultsChan for all files and directories currently tracked in the
 //database. nil will be sent to signify there are no more events. If an error
 //occurs, it will be send down errorChan and no more events will be sent.
 func (adb *AsinkDB) DatabaseGetAllFiles(resultChan chan *asink.Event, errorChan chan error) {
@@ -175,9 +326,9 @@ func (adb *AsinkDB) DatabaseGetAllFiles(resultChan chan *asink.Event, errorChan
 
 	//This query selects only the files currently tracked and not deleted.
 	//It does so by doing an inner join from the events table onto itself,
-	//and only selecting a row if its timestamp is greater than all others
-	//that share its path AND it is not a deletion event.
-	rows, err := adb.db.Query("SELECT e1.id, e1.localid, e1.type, e1.localstatus, e1.path, e1.hash, e1.predecessor, e1.timestamp, e1.permissions FROM events AS e1 LEFT OUTER JOIN events as e2 ON e1.path = e2.path AND (e1.timestamp < e2.timestamp OR (e1.timestamp = e2.timestamp AND e1.id < e2.id)) WHERE e2.id IS NULL AND e1.type = ?;", asink.UPDATE)
+	//and only selecting a row if its clock is greater than all others
+	//that share its path AND it is an update (not a deletion) event.
+	rows, err := adb.db.Query("SELECT "+eventColumnsAs("e1")+" FROM events AS e1 LEFT OUTER JOIN events as e2 ON e1.path = e2.path AND (e1.clock < e2.clock OR (e1.clock = e2.clock AND e1.localid < e2.localid)) WHERE e2.id IS NULL AND (e1.type & ?) != 0;", asink.UPDATE)
 	if err != nil {
 		errorChan <- err
 		return
@@ -185,8 +336,7 @@ func (adb *AsinkDB) DatabaseGetAllFiles(resultChan chan *asink.Event, errorChan
 
 	go func() {
 		for rows.Next() {
-			event := new(asink.Event)
-			err := rows.Scan(&event.Id, &event.LocalId, &event.Type, &event.LocalStatus, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions)
+			event, err := scanEvent(rows)
 			if err != nil {
 				adb.lock.Unlock()
 				errorChan <- err
@@ -199,3 +349,274 @@ func (adb *AsinkDB) DatabaseGetAllFiles(resultChan chan *asink.Event, errorChan
 		resultChan <- nil
 	}()
 }
+
+//returns nil if no hash is cached for this path
+func (adb *AsinkDB) DatabaseGetHashCacheEntry(path string) (entry *HashCacheEntry, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT path, device, inode, size, mtime, ctime, hash FROM hashcache WHERE path == ?;", path)
+
+	entry = new(HashCacheEntry)
+	err = row.Scan(&entry.Path, &entry.Device, &entry.Inode, &entry.Size, &entry.MTime, &entry.CTime, &entry.Hash)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		return entry, nil
+	}
+}
+
+//adds or replaces the hash cache entry for entry.Path
+func (adb *AsinkDB) DatabaseSetHashCacheEntry(entry *HashCacheEntry) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO hashcache (path, device, inode, size, mtime, ctime, hash) VALUES (?,?,?,?,?,?,?);", entry.Path, entry.Device, entry.Inode, entry.Size, entry.MTime, entry.CTime, entry.Hash)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//returns nil if no hash is cached for a file with this device and inode
+func (adb *AsinkDB) DatabaseGetHashCacheEntryByInode(device, inode uint64) (entry *HashCacheEntry, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT path, device, inode, size, mtime, ctime, hash FROM hashcache WHERE device == ? AND inode == ?;", device, inode)
+
+	entry = new(HashCacheEntry)
+	err = row.Scan(&entry.Path, &entry.Device, &entry.Inode, &entry.Size, &entry.MTime, &entry.CTime, &entry.Hash)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		return entry, nil
+	}
+}
+
+//Moves the hash cache entries for src, and everything inside it if it is a
+//directory, to dst. Any entries previously at dst are replaced.
+func (adb *AsinkDB) DatabaseMoveHashCacheEntries(src, dst string) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	//paths inside a directory sort between "dir/" and "dir0" ('0' follows '/')
+	_, err = tx.Exec("DELETE FROM hashcache WHERE path == ? OR (path >= ? AND path < ?);", dst, dst+"/", dst+"0")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE hashcache SET path = ? || substr(path, ?) WHERE path == ? OR (path >= ? AND path < ?);", dst, utf8.RuneCountInString(src)+1, src, src+"/", src+"0")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (adb *AsinkDB) DatabaseRemoveHashCacheEntry(path string) (err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	_, err = adb.db.Exec("DELETE FROM hashcache WHERE path == ?;", path)
+	return err
+}
+
+//forget all cached hashes, forcing every file to be re-hashed the next time
+//it is seen
+func (adb *AsinkDB) DatabaseClearHashCache() (err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	_, err = adb.db.Exec("DELETE FROM hashcache;")
+	return err
+}
+
+//Returns every event we have for path, oldest first
+func (adb *AsinkDB) DatabaseGetHistory(path string) (events []*asink.Event, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT "+eventColumns+" FROM events WHERE path == ? ORDER BY clock ASC, localid ASC;", path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+//Returns the latest event for each file and directory currently tracked
+//inside dir (not including dir itself).
+func (adb *AsinkDB) DatabaseGetTrackedChildren(dir string) (events []*asink.Event, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	//See DatabaseGetAllFiles() for an explanation of this query. Paths
+	//inside a directory sort between "dir/" and "dir0" ('0' follows '/').
+	rows, err := adb.db.Query("SELECT "+eventColumnsAs("e1")+" FROM events AS e1 LEFT OUTER JOIN events as e2 ON e1.path = e2.path AND (e1.clock < e2.clock OR (e1.clock = e2.clock AND e1.localid < e2.localid)) WHERE e2.id IS NULL AND (e1.type & ?) != 0 AND e1.path >= ? AND e1.path < ?;", asink.UPDATE, dir+"/", dir+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+//returns "" if no value has been stored for name
+func (adb *AsinkDB) DatabaseGetState(name string) (value string, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT value FROM state WHERE name == ?;", name)
+	err = row.Scan(&value)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", err
+	default:
+		return value, nil
+	}
+}
+
+//adds or replaces the value stored for name
+func (adb *AsinkDB) DatabaseSetState(name, value string) (err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	_, err = adb.db.Exec("INSERT OR REPLACE INTO state (name, value) VALUES (?,?);", name, value)
+	return err
+}
+
+func (adb *AsinkDB) DatabaseAddConflict(c *Conflict) (err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	result, err := adb.db.Exec("INSERT INTO conflicts (path, localhash, localonly, remotehash, remoteuser, remotedevice, policy, localwon, copypath, timestamp, resolved) VALUES (?,?,?,?,?,?,?,?,?,?,?);", c.Path, c.LocalHash, c.LocalOnly, c.RemoteHash, c.RemoteUser, c.RemoteDevice, c.Policy, c.LocalWon, c.CopyPath, c.Timestamp, c.Resolved)
+	if err != nil {
+		return err
+	}
+	c.Id, err = result.LastInsertId()
+	return err
+}
+
+func scanConflict(row rowScanner) (*Conflict, error) {
+	c := new(Conflict)
+	err := row.Scan(&c.Id, &c.Path, &c.LocalHash, &c.LocalOnly, &c.RemoteHash, &c.RemoteUser, &c.RemoteDevice, &c.Policy, &c.LocalWon, &c.CopyPath, &c.Timestamp, &c.Resolved)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Returns the conflicts no one has decided which version to keep for yet,
+//oldest first
+func (adb *AsinkDB) DatabaseGetUnresolvedConflicts() (conflicts []*Conflict, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT id, path, localhash, localonly, remotehash, remoteuser, remotedevice, policy, localwon, copypath, timestamp, resolved FROM conflicts WHERE resolved == 0 ORDER BY timestamp ASC, id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+//Returns the latest unresolved conflict for path, or nil if there isn't one
+func (adb *AsinkDB) DatabaseGetUnresolvedConflict(path string) (c *Conflict, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT id, path, localhash, localonly, remotehash, remoteuser, remotedevice, policy, localwon, copypath, timestamp, resolved FROM conflicts WHERE path == ? AND resolved == 0 ORDER BY timestamp DESC, id DESC LIMIT 1;", path)
+	c, err = scanConflict(row)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		return c, nil
+	}
+}
+
+func (adb *AsinkDB) DatabaseResolveConflict(id int64) (err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	_, err = adb.db.Exec("UPDATE conflicts SET resolved = 1 WHERE id == ?;", id)
+	return err
+}
@@ -28,3 +28,37 @@ func HashFile(filename string) (string, error) {
 
 	return fmt.Sprintf("%x", hashfn.Sum(nil)), nil
 }
+
+//The attributes of a file at the time it was hashed. If none of these have
+//changed, the file's contents are assumed not to have changed either, so the
+//file doesn't need to be copied and hashed again.
+type HashCacheEntry struct {
+	Path   string
+	Device uint64
+	Inode  uint64
+	Size   int64
+	MTime  int64 //nanoseconds
+	CTime  int64 //nanoseconds
+	Hash   string
+}
+
+//returns nil if the underlying stat information is unavailable
+func NewHashCacheEntry(path string, info os.FileInfo) *HashCacheEntry {
+	entry := new(HashCacheEntry)
+	entry.Path = path
+	entry.Size = info.Size()
+	if !fillStatInfo(entry, info) {
+		return nil
+	}
+	return entry
+}
+
+func (e *HashCacheEntry) Matches(e2 *HashCacheEntry) bool {
+	return e.Path == e2.Path && e.SameFile(e2) && e.CTime == e2.CTime
+}
+
+//returns true if both entries refer to the same, unmodified, file (possibly
+//at different paths)
+func (e *HashCacheEntry) SameFile(e2 *HashCacheEntry) bool {
+	return e.Device == e2.Device && e.Inode == e2.Inode && e.Size == e2.Size && e.MTime == e2.MTime
+}
@@ -0,0 +1,24 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//fills in the device, inode, and modification/change times of entry from
+//info, returning false if they are unavailable
+func fillStatInfo(entry *HashCacheEntry, info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	entry.Device = uint64(stat.Dev)
+	entry.Inode = uint64(stat.Ino)
+	entry.MTime = syscall.TimespecToNsec(stat.Mtim)
+	entry.CTime = syscall.TimespecToNsec(stat.Ctim)
+	return true
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"os"
+)
+
+//the hash cache is only supported on Linux, so every file is re-hashed
+
+func fillStatInfo(entry *HashCacheEntry, info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,52 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"time"
+)
+
+//Describes each of events on its own line, saying who changed the file and
+//from which device
+func FormatHistory(globals *AsinkGlobals, events []*asink.Event) string {
+	if len(events) == 0 {
+		return "No history\n"
+	}
+
+	history := ""
+	for _, event := range events {
+		line := time.Unix(0, event.Timestamp).Format("2006-01-02 15:04:05")
+		switch {
+		case event.IsDelete():
+			line += "  deleted"
+		case event.IsMove():
+			line += "  moved from " + event.SourcePath
+		case event.IsSymlink():
+			line += "  linked to " + event.LinkTarget
+		case event.IsDirectory():
+			line += "  created directory"
+		default:
+			line += "  updated"
+			if len(event.Hash) >= 12 {
+				line += " to " + event.Hash[:12]
+			}
+		}
+
+		if event.Username != "" {
+			line += " by " + event.Username
+		}
+		if device := eventDeviceName(globals, event); device != "" {
+			line += " on " + device
+		}
+		if event.Id == 0 {
+			line += " (not yet sent to the server)"
+		} else if event.LocalStatus&asink.SKIPPED != 0 {
+			line += " (not downloaded)"
+		}
+		history += line + "\n"
+	}
+	return history
+}
@@ -0,0 +1,241 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//name of the files which may be placed in any directory under syncdir to
+//specify which files in that directory should not be synchronized
+const IGNORE_FILENAME = ".asinkignore"
+
+type ignorePattern struct {
+	regexp   *regexp.Regexp
+	negate   bool //pattern began with '!', and re-includes anything it matches
+	dirOnly  bool //pattern ended with '/', and only matches directories
+	basename bool //pattern had no '/', and matches the last path component at any depth
+}
+
+//Holds the gitignore-style rules from the global ignore list and all the
+//.asinkignore files found under the sync directory. All paths passed to its
+//methods are relative to the sync directory.
+type IgnoreRules struct {
+	lock      sync.RWMutex
+	root      string
+	selection *Selection //paths outside the selected subtrees are ignored as well
+	global    []*ignorePattern
+	dirs      map[string][]*ignorePattern //keyed by the directory containing the .asinkignore, "" for root
+}
+
+func NewIgnoreRules(root string, selection *Selection, globalPatterns []string) *IgnoreRules {
+	ir := new(IgnoreRules)
+	ir.root = root
+	ir.selection = selection
+	ir.dirs = make(map[string][]*ignorePattern)
+	for _, p := range globalPatterns {
+		if pattern := parseIgnorePattern(p); pattern != nil {
+			ir.global = append(ir.global, pattern)
+		}
+	}
+	return ir
+}
+
+//converts a gitignore-style glob into an equivalent regular expression
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				if i+2 < len(glob) && glob[i+2] == '/' {
+					//"**/" matches zero or more leading directories
+					buf.WriteString("(.*/)?")
+					i += 2
+				} else {
+					//"**" elsewhere matches everything, including slashes
+					buf.WriteString(".*")
+					i++
+				}
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 1 {
+				buf.WriteString(`\[`)
+				break
+			}
+			class := glob[i+1 : i+1+end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+//returns nil if the line is blank, a comment, or otherwise unusable
+func parseIgnorePattern(line string) *ignorePattern {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	pattern := new(ignorePattern)
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	pattern.basename = !strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(globToRegexp(line))
+	if err != nil {
+		return nil
+	}
+	pattern.regexp = re
+	return pattern
+}
+
+func (p *ignorePattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.basename {
+		return p.regexp.MatchString(path.Base(relPath))
+	}
+	return p.regexp.MatchString(relPath)
+}
+
+//(re-)reads the .asinkignore file in the given directory (which may be
+//absolute, or relative to the sync directory). If the file no longer exists,
+//any rules previously loaded from it are forgotten.
+func (ir *IgnoreRules) LoadDir(dir string) error {
+	relDir, err := ir.relative(dir)
+	if err != nil {
+		return err
+	}
+
+	var patterns []*ignorePattern
+	f, err := os.Open(filepath.Join(ir.root, relDir, IGNORE_FILENAME))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if pattern := parseIgnorePattern(scanner.Text()); pattern != nil {
+				patterns = append(patterns, pattern)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+	if len(patterns) > 0 {
+		ir.dirs[relDir] = patterns
+	} else {
+		delete(ir.dirs, relDir)
+	}
+	return nil
+}
+
+//returns p relative to the sync directory, with "" representing the sync
+//directory itself
+func (ir *IgnoreRules) relative(p string) (string, error) {
+	if filepath.IsAbs(p) {
+		var err error
+		p, err = filepath.Rel(ir.root, p)
+		if err != nil {
+			return "", err
+		}
+	}
+	p = path.Clean(p)
+	if p == "." {
+		return "", nil
+	}
+	return p, nil
+}
+
+//returns true if relPath itself (not considering its parents) is matched by
+//the rules in effect, with later rules overriding earlier ones
+func (ir *IgnoreRules) matches(relPath string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range ir.global {
+		if pattern.matches(relPath, isDir) {
+			ignored = !pattern.negate
+		}
+	}
+
+	//apply the rules from each .asinkignore between the root and relPath
+	parts := strings.Split(relPath, "/")
+	for i := 0; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		relToDir := strings.Join(parts[i:], "/")
+		for _, pattern := range ir.dirs[dir] {
+			if pattern.matches(relToDir, isDir) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	return ignored
+}
+
+//Returns true if p (either absolute, or relative to the sync directory)
+//should not be synchronized, either because it matches an ignore rule or
+//because it isn't selected. As with gitignore, nothing inside an ignored
+//directory can be re-included.
+func (ir *IgnoreRules) Ignored(p string, isDir bool) bool {
+	relPath, err := ir.relative(p)
+	if err != nil || relPath == "" || strings.HasPrefix(relPath, "../") {
+		return false
+	}
+	if ir.selection != nil && !ir.selection.Selected(relPath) {
+		return true
+	}
+
+	ir.lock.RLock()
+	defer ir.lock.RUnlock()
+
+	parts := strings.Split(relPath, "/")
+	for i := 1; i <= len(parts); i++ {
+		if ir.matches(strings.Join(parts[:i], "/"), i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorePatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		{"*.o", "main.o", false, true},
+		{"*.o", "src/lib/util.o", false, true},
+		{"*.o", "main.c", false, false},
+		{"*.o", "main.o.c", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "build", false, true},
+		{"/build", "src/build", false, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/server/notes.txt", false, false},
+		{"doc/*.txt", "src/doc/notes.txt", false, false},
+		{"**/logs", "logs", true, true},
+		{"**/logs", "a/b/logs", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**", "a/x/y", false, true},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"file[0-9].txt", "file5.txt", false, true},
+		{"file[!0-9].txt", "file5.txt", false, false},
+		{"file[!0-9].txt", "fileA.txt", false, true},
+		{"[", "[", false, true},
+		{`\#notacomment`, "#notacomment", false, true},
+		{`\!important`, "!important", false, true},
+		{"a.b", "axb", false, false},
+		{"!*.log", "debug.log", false, true},
+	}
+
+	for _, test := range tests {
+		pattern := parseIgnorePattern(test.pattern)
+		if pattern == nil {
+			t.Errorf("%q: failed to parse", test.pattern)
+			continue
+		}
+		if matches := pattern.matches(test.path, test.isDir); matches != test.matches {
+			t.Errorf("%q matching %q (directory: %v) returned %v, expected %v", test.pattern, test.path, test.isDir, matches, test.matches)
+		}
+	}
+}
+
+func TestParseIgnorePattern(t *testing.T) {
+	for _, line := range []string{"", "   ", "# a comment", "/", "!"} {
+		if pattern := parseIgnorePattern(line); pattern != nil {
+			t.Errorf("%q: expected no pattern", line)
+		}
+	}
+
+	pattern := parseIgnorePattern("  !build/  ")
+	if pattern == nil {
+		t.Fatal("\"!build/\": failed to parse")
+	}
+	if !pattern.negate || !pattern.dirOnly || !pattern.basename {
+		t.Errorf("\"!build/\": parsed to %+v", pattern)
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	root, err := ioutil.TempDir("", "asink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = os.MkdirAll(filepath.Join(root, "src", "vendor"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "src", IGNORE_FILENAME), []byte("# generated files\n*.gen\n!keep.gen\n/vendor/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ir := NewIgnoreRules(root, nil, []string{"*.log", "tmp/", "!important.log"})
+	err = ir.LoadDir(filepath.Join(root, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"debug.log", false, true},
+		{"important.log", false, false},
+		{"docs/debug.log", false, true},
+		{"tmp", true, true},
+		{"tmp", false, false},
+		{"tmp/important.log", false, true}, //inside an ignored directory
+		{"src/main.go", false, false},
+		{"src/main.gen", false, true},
+		{"src/keep.gen", false, false},
+		{"main.gen", false, false}, //outside the directory of the .asinkignore
+		{"src/vendor", true, true},
+		{"src/vendor/lib.go", false, true},
+		{"src/lib/vendor", true, false},
+		{filepath.Join(root, "debug.log"), false, true},
+		{filepath.Join(root, "src", "main.go"), false, false},
+		{"", true, false},
+		{"../outside.log", false, false},
+	}
+
+	for _, test := range tests {
+		if ignored := ir.Ignored(test.path, test.isDir); ignored != test.ignored {
+			t.Errorf("%q (directory: %v): ignored was %v, expected %v", test.path, test.isDir, ignored, test.ignored)
+		}
+	}
+
+	//rules are forgotten once their .asinkignore is removed
+	err = os.Remove(filepath.Join(root, "src", IGNORE_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ir.LoadDir("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Ignored("src/main.gen", false) {
+		t.Error("\"src/main.gen\" still ignored after removing its .asinkignore")
+	}
+}
@@ -32,6 +32,21 @@ var commands []Command = []Command{
 		fn:          GetStatus,
 		explanation: "Get a summary of the client's status",
 	},
+	Command{
+		cmd:         "history",
+		fn:          GetHistory,
+		explanation: "List the versions of a file this client knows about",
+	},
+	Command{
+		cmd:         "conflicts",
+		fn:          GetConflicts,
+		explanation: "List conflicts which haven't been resolved",
+	},
+	Command{
+		cmd:         "resolve",
+		fn:          ResolveConflict,
+		explanation: "Resolve a conflict by choosing which version of a file to keep",
+	},
 	Command{
 		cmd:         "version",
 		fn:          PrintVersion,
@@ -0,0 +1,299 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aclindsa/asink"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+//Diffs needing more than this many insertions and deletions are given up
+//on, since the time and memory they take grow with its square
+const MAX_MERGE_EDITS = 4000
+
+var TooManyEditsErr = errors.New("Too many changes to merge")
+var NotTextErr = errors.New("Not a text file")
+
+//Splits text into lines, each keeping its trailing newline (the last may not
+//have one)
+func splitLines(text []byte) [][]byte {
+	var lines [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+//Returns, for each line of a, the index of the line of b it is paired with
+//in a longest common subsequence of the two, or -1 if it isn't in it. This
+//uses Myers' O(ND) diff algorithm.
+func matchLines(a, b [][]byte) ([]int, error) {
+	//compare numbers rather than the lines themselves
+	ids := make(map[string]int)
+	toIds := func(lines [][]byte) []int {
+		result := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[string(line)]
+			if !ok {
+				id = len(ids)
+				ids[string(line)] = id
+			}
+			result[i] = id
+		}
+		return result
+	}
+	x, y := toIds(a), toIds(b)
+	n, m := len(x), len(y)
+
+	//v[offset+k] is the furthest x reached on diagonal k. trace[d] holds
+	//the part of v which round d reads (k from -d-1 to d+1), as it was
+	//before that round.
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && !found; d++ {
+		if d > MAX_MERGE_EDITS {
+			return nil, TooManyEditsErr
+		}
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				i = v[offset+k+1]
+			} else {
+				i = v[offset+k-1] + 1
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			v[offset+k] = i
+			if i >= n && j >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	matches := make([]int, n)
+	for i := range matches {
+		matches[i] = -1
+	}
+	i, j := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		snapshot := trace[d]
+		k := i - j
+		var prevK int
+		if k == -d || (k != d && snapshot[k-1+d+1] < snapshot[k+1+d+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevI := snapshot[prevK+d+1]
+		prevJ := prevI - prevK
+		for i > prevI && j > prevJ {
+			i--
+			j--
+			matches[i] = j
+		}
+		i, j = prevI, prevJ
+	}
+	for i > 0 && j > 0 {
+		i--
+		j--
+		matches[i] = j
+	}
+	return matches, nil
+}
+
+func sameLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//Merges the changes made to base in local and in remote, line by line, the
+//same way diff3 does. Where both changed the same lines differently, both
+//versions are included between conflict markers labelled with localLabel and
+//remoteLabel, and clean is false.
+func merge3(base, local, remote []byte, localLabel, remoteLabel string) (merged []byte, clean bool, err error) {
+	o, a, b := splitLines(base), splitLines(local), splitLines(remote)
+	matchA, err := matchLines(o, a)
+	if err != nil {
+		return nil, false, err
+	}
+	matchB, err := matchLines(o, b)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var out bytes.Buffer
+	write := func(lines [][]byte) {
+		for _, line := range lines {
+			out.Write(line)
+		}
+	}
+	//conflict markers must start their own lines
+	writeSide := func(lines [][]byte) {
+		write(lines)
+		if len(lines) > 0 && !bytes.HasSuffix(lines[len(lines)-1], []byte("\n")) {
+			out.WriteByte('\n')
+		}
+	}
+
+	clean = true
+	lo, la, lb := 0, 0, 0
+	for lo < len(o) || la < len(a) || lb < len(b) {
+		//lines unchanged in both
+		i := 0
+		for lo+i < len(o) && matchA[lo+i] == la+i && matchB[lo+i] == lb+i {
+			i++
+		}
+		if i > 0 {
+			write(o[lo : lo+i])
+			lo, la, lb = lo+i, la+i, lb+i
+			continue
+		}
+
+		//find where they next agree, and merge the changes before it
+		next := lo
+		for next < len(o) && (matchA[next] < 0 || matchB[next] < 0) {
+			next++
+		}
+		endA, endB := len(a), len(b)
+		if next < len(o) {
+			endA, endB = matchA[next], matchB[next]
+		}
+		baseChunk, localChunk, remoteChunk := o[lo:next], a[la:endA], b[lb:endB]
+		switch {
+		case sameLines(localChunk, baseChunk):
+			write(remoteChunk)
+		case sameLines(remoteChunk, baseChunk), sameLines(localChunk, remoteChunk):
+			write(localChunk)
+		default:
+			clean = false
+			out.WriteString("<<<<<<< " + localLabel + "\n")
+			writeSide(localChunk)
+			out.WriteString("=======\n")
+			writeSide(remoteChunk)
+			out.WriteString(">>>>>>> " + remoteLabel + "\n")
+		}
+		lo, la, lb = next, endA, endB
+	}
+	return out.Bytes(), clean, nil
+}
+
+//Returns true if local and remote are both changes to the contents of a
+//regular file, which can be merged
+func canMerge(local, remote *asink.Event) bool {
+	for _, e := range []*asink.Event{local, remote} {
+		if !e.IsUpdate() || e.IsDirectory() || e.IsSymlink() || e.Hash == "" {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the contents of the file with the given hash, downloading it into
+//the cache if it isn't there already
+func cachedContents(globals *AsinkGlobals, hash string) ([]byte, error) {
+	cachedFilename := path.Join(globals.cacheDir, hash)
+	if _, err := os.Stat(cachedFilename); err != nil {
+		err = downloadToCache(globals, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readText(cachedFilename)
+}
+
+func readText(filename string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(contents, 0) >= 0 {
+		return nil, NotTextErr
+	}
+	return contents, nil
+}
+
+//Merges the local (read from localFile) and remote versions of a text file,
+//starting from the version local was made to. The result is put in the cache,
+//and its hash returned, along with whether it merged cleanly (if not, it
+//contains conflict markers).
+func mergeVersions(globals *AsinkGlobals, local, remote *asink.Event, localFile string) (hash string, clean bool, err error) {
+	var base []byte
+	if local.Predecessor != "" {
+		base, err = cachedContents(globals, local.Predecessor)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	localContents, err := readText(localFile)
+	if err != nil {
+		return "", false, err
+	}
+	remoteContents, err := cachedContents(globals, remote.Hash)
+	if err != nil {
+		return "", false, err
+	}
+
+	localLabel, remoteLabel := eventDeviceName(globals, local), eventDeviceName(globals, remote)
+	if localLabel == "" {
+		localLabel = "local"
+	}
+	if remoteLabel == "" {
+		remoteLabel = "remote"
+	}
+	merged, clean, err := merge3(base, localContents, remoteContents, localLabel, remoteLabel)
+	if err != nil {
+		return "", false, err
+	}
+
+	outfile, err := ioutil.TempFile(globals.tmpDir, "asink")
+	if err != nil {
+		return "", false, err
+	}
+	tmpfilename := outfile.Name()
+	_, err = outfile.Write(merged)
+	outfile.Close()
+	if err != nil {
+		os.Remove(tmpfilename)
+		return "", false, err
+	}
+	hash, err = HashFile(tmpfilename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return "", false, err
+	}
+	err = os.Rename(tmpfilename, path.Join(globals.cacheDir, hash))
+	if err != nil {
+		os.Remove(tmpfilename)
+		return "", false, err
+	}
+	return hash, clean, nil
+}
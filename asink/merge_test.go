@@ -0,0 +1,81 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		merged              string
+		clean               bool
+	}{
+		{"local unchanged", "a\nb\nc\n", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", true},
+		{"remote unchanged", "a\nb\nc\n", "a\nb\nC\n", "a\nb\nc\n", "a\nb\nC\n", true},
+		{"both unchanged", "a\nb\n", "a\nb\n", "a\nb\n", "a\nb\n", true},
+		{"identical edits", "a\nb\nc\n", "a\nx\nc\n", "a\nx\nc\n", "a\nx\nc\n", true},
+		{"separate edits", "a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"insertions and deletions", "a\nb\nc\nd\ne\n", "new\na\nb\nc\nd\ne\n", "a\nb\nc\nd\n", "new\na\nb\nc\nd\n", true},
+		{"overlapping edits", "a\nb\nc\n", "a\nx\nc\n", "a\ny\nc\n", "a\n<<<<<<< local\nx\n=======\ny\n>>>>>>> remote\nc\n", false},
+		{"edit and delete", "a\nb\nc\n", "a\nx\nc\n", "a\nc\n", "a\n<<<<<<< local\nx\n=======\n>>>>>>> remote\nc\n", false},
+		{"all empty", "", "", "", "", true},
+		{"empty base, one side added", "", "a\nb\n", "", "a\nb\n", true},
+		{"empty base, both added", "", "a\n", "b\n", "<<<<<<< local\na\n=======\nb\n>>>>>>> remote\n", false},
+		{"emptied", "a\nb\n", "", "a\nb\n", "", true},
+		{"no trailing newline, clean", "a\nb\nc", "A\nb\nc", "a\nb\nC", "A\nb\nC", true},
+		{"no trailing newline added", "a\nb\n", "a\nb", "a\nb\n", "a\nb", true},
+		{"no trailing newline, overlapping", "a\nb", "a\nx", "a\ny", "a\n<<<<<<< local\nx\n=======\ny\n>>>>>>> remote\n", false},
+	}
+
+	for _, test := range tests {
+		merged, clean, err := merge3([]byte(test.base), []byte(test.local), []byte(test.remote), "local", "remote")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if string(merged) != test.merged {
+			t.Errorf("%s: merged to %q, expected %q", test.name, merged, test.merged)
+		}
+		if clean != test.clean {
+			t.Errorf("%s: clean was %v, expected %v", test.name, clean, test.clean)
+		}
+	}
+}
+
+func TestMatchLines(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		matches []int
+	}{
+		{"", "", []int{}},
+		{"a\n", "", []int{-1}},
+		{"a\nb\nc\n", "a\nb\nc\n", []int{0, 1, 2}},
+		{"a\nb\nc\n", "a\nc\n", []int{0, -1, 1}},
+		{"a\nc\n", "a\nb\nc\n", []int{0, 2}},
+		{"a\nb\nc\nd\n", "x\nb\nc\ny\n", []int{-1, 1, 2, -1}},
+		{"a\nb", "a\nb\n", []int{0, -1}},
+	}
+
+	for _, test := range tests {
+		matches, err := matchLines(splitLines([]byte(test.a)), splitLines([]byte(test.b)))
+		if err != nil {
+			t.Errorf("%q, %q: unexpected error: %s", test.a, test.b, err)
+			continue
+		}
+		if len(matches) != len(test.matches) {
+			t.Errorf("%q, %q: matched %v, expected %v", test.a, test.b, matches, test.matches)
+			continue
+		}
+		for i := range matches {
+			if matches[i] != test.matches[i] {
+				t.Errorf("%q, %q: matched %v, expected %v", test.a, test.b, matches, test.matches)
+				break
+			}
+		}
+	}
+}
@@ -5,15 +5,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aclindsa/asink"
+	"github.com/aclindsa/asink/util"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,19 +27,39 @@ const MIN_ERROR_WAIT = 100   // 1/10 of a second
 const MAX_ERROR_WAIT = 10000 // 10 seconds
 const MAX_SEND_AT_ONCE = 50  //maximum number of events to send to the server at once
 
-type sendEventRequest struct {
-	event      *asink.Event
-	returnChan *chan error
+//how long a stream of events may go without even a heartbeat from the server
+//before we reconnect (the server sends them every 30 seconds)
+const STREAM_TIMEOUT = 90 * time.Second
+
+var StreamingUnsupportedErr = errors.New("Server doesn't support streaming events")
+var SnapshotUnsupportedErr = errors.New("Server doesn't support snapshots")
+
+//returned for events the server refused to accept
+type EventRejectedError struct {
+	Explanation string
 }
 
-var sendEventsChan chan *sendEventRequest
+func (e EventRejectedError) Error() string {
+	return "Server rejected event: " + e.Explanation
+}
 
-func init() {
-	sendEventsChan = make(chan *sendEventRequest)
+//returned for events the server refused to accept because the file they
+//change was changed by someone else first
+type EventConflictError struct {
+	Explanation string
+	Head        *asink.Event //the current version of the path on the server
 }
 
-func AuthenticatedRequest(method, url, bodyType string, body io.Reader, username, password string) (*http.Response, error) {
-	client := &http.Client{}
+func (e EventConflictError) Error() string {
+	return "Conflicting event: " + e.Explanation
+}
+
+type sendEventRequest struct {
+	event      *asink.Event
+	returnChan *chan error
+}
+
+func newAuthenticatedRequest(method, url, bodyType string, body io.Reader, username, password string) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
@@ -41,7 +67,16 @@ func AuthenticatedRequest(method, url, bodyType string, body io.Reader, username
 	if bodyType != "" {
 		req.Header.Set("Content-Type", bodyType)
 	}
+	req.Header.Set(asink.API_VERSION_HEADER, strconv.Itoa(asink.API_VERSIONS[len(asink.API_VERSIONS)-1]))
 	req.SetBasicAuth(username, password)
+	return req, nil
+}
+func AuthenticatedRequest(method, url, bodyType string, body io.Reader, username, password string) (*http.Response, error) {
+	client := &http.Client{}
+	req, err := newAuthenticatedRequest(method, url, bodyType, body, username, password)
+	if err != nil {
+		return nil, err
+	}
 	return client.Do(req)
 }
 func AuthenticatedGet(url string, username, password string) (*http.Response, error) {
@@ -51,43 +86,264 @@ func AuthenticatedPost(url, bodyType string, body io.Reader, username, password
 	return AuthenticatedRequest("POST", url, bodyType, body, username, password)
 }
 
-func actuallySendEvents(globals *AsinkGlobals, events []*asink.Event) error {
-	url := "http://" + globals.server + ":" + strconv.Itoa(int(globals.port)) + "/events/"
+func serverURL(globals *AsinkGlobals) string {
+	return "http://" + globals.server + ":" + strconv.Itoa(int(globals.port))
+}
 
-	//construct json payload
-	eventStruct := asink.EventList{
-		Events: events,
+//How to talk to the server, as negotiated with it
+type apiSettings struct {
+	base        string        //of the negotiated version of the API, ending in '/'
+	url         string        //of this sync root's share, ending in '/'
+	contentType string        //used for requests and responses
+	gzip        bool          //whether requests may be gzipped
+	device      *asink.Device //this device, as registered with the server, or nil if it doesn't support devices
+}
+
+//Asks the server which versions of the API and encodings it supports, and
+//picks the newest/most compact ones we support too. If there is no common
+//version, the error returned is a CONFIG ProcessingError.
+func negotiateAPI(globals *AsinkGlobals) (*apiSettings, error) {
+	resp, err := http.Get(serverURL(globals) + "/")
+	if err != nil {
+		return nil, err
 	}
-	b, err := json.Marshal(eventStruct)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	//actually make the request
-	resp, err := AuthenticatedPost(url, "application/json", bytes.NewReader(b), globals.username, globals.password)
+	var supported asink.APIVersions
+	err = json.Unmarshal(body, &supported)
+	if err != nil || len(supported.Versions) == 0 {
+		return nil, ProcessingError{CONFIG, errors.New("Error: the server at " + serverURL(globals) + " doesn't say which versions of the Asink API it supports, so it is probably older than this client. Please upgrade it.")}
+	}
+
+	version := 0
+	for _, v := range supported.Versions {
+		if asink.SupportsAPIVersion(v) && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return nil, ProcessingError{CONFIG, fmt.Errorf("Error: the server at %s (version %s) supports versions %v of the Asink API, but this client only supports versions %v. Please upgrade whichever is older.", serverURL(globals), supported.ServerVersion, supported.Versions, asink.API_VERSIONS)}
+	}
+
+	api := new(apiSettings)
+	api.base = serverURL(globals) + "/v" + strconv.Itoa(version) + "/"
+	api.url = api.base + "shares/" + globals.share + "/"
+	api.contentType = asink.NegotiateContentType(strings.Join(supported.ContentTypes, ","))
+	api.gzip = asink.AcceptsGzip(strings.Join(supported.ContentEncodings, ","))
+	return api, nil
+}
+
+//Returns how to talk to the server, which is negotiated the first time it is
+//needed
+func getAPI(globals *AsinkGlobals) (*apiSettings, error) {
+	globals.apiLock.Lock()
+	defer globals.apiLock.Unlock()
+	if globals.api == nil {
+		api, err := negotiateAPI(globals)
+		if err != nil {
+			return nil, err
+		}
+		api.device, err = registerDevice(globals, api)
+		if err != nil {
+			return nil, err
+		}
+		globals.api = api
+	}
+	return globals.api, nil
+}
+
+//the names under which this device's id, token, and name are stored in the
+//database
+const DEVICE_ID_STATE = "deviceid"
+const DEVICE_TOKEN_STATE = "devicetoken"
+const DEVICE_NAME_STATE = "devicename"
+
+//Returns this device, registering it with the server the first time we talk
+//to it. Returns nil if the server is too old to support devices.
+func registerDevice(globals *AsinkGlobals, api *apiSettings) (*asink.Device, error) {
+	deviceId, err := globals.db.DatabaseGetState(DEVICE_ID_STATE)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if deviceId != "" {
+		device := &asink.Device{Name: globals.deviceName}
+		device.Id, err = strconv.ParseInt(deviceId, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		device.Token, err = globals.db.DatabaseGetState(DEVICE_TOKEN_STATE)
+		if err != nil {
+			return nil, err
+		}
+		return device, nil
+	}
+
+	var buffer bytes.Buffer
+	err = asink.Encode(&buffer, api.contentType, asink.Device{Name: globals.deviceName})
+	if err != nil {
+		return nil, err
+	}
+	req, err := newAuthenticatedRequest("POST", api.base+"devices", api.contentType, &buffer, globals.username, globals.password)
+	if err != nil {
+		return nil, err
+	}
+	acceptNegotiated(req, api, api.contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	//check to make sure request succeeded
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var apistatus asink.APIResponse
+	err = decodeResponse(resp, &apistatus)
+	if err != nil {
+		return nil, err
+	}
+	err = responseError(&apistatus)
+	if err != nil {
+		return nil, err
+	}
+	if apistatus.Device == nil {
+		return nil, errors.New("Server didn't return the device it registered")
+	}
+
+	//the token can't be retrieved again, so save it before using it
+	err = globals.db.DatabaseSetState(DEVICE_TOKEN_STATE, apistatus.Device.Token)
+	if err != nil {
+		return nil, err
+	}
+	err = globals.db.DatabaseSetState(DEVICE_NAME_STATE, apistatus.Device.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = globals.db.DatabaseSetState(DEVICE_ID_STATE, strconv.FormatInt(apistatus.Device.Id, 10))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(globals.name + ": registered this device with the server as '" + apistatus.Device.Name + "'")
+	return apistatus.Device, nil
+}
+
+//Returns a request to the server, authenticated as both our user and this
+//device
+func newAPIRequest(globals *AsinkGlobals, api *apiSettings, method, url, bodyType string, body io.Reader) (*http.Request, error) {
+	req, err := newAuthenticatedRequest(method, url, bodyType, body, globals.username, globals.password)
+	if err != nil {
+		return nil, err
+	}
+	if api.device != nil {
+		req.Header.Set(asink.DEVICE_HEADER, strconv.FormatInt(api.device.Id, 10))
+		req.Header.Set(asink.DEVICE_TOKEN_HEADER, api.device.Token)
+	}
+	return req, nil
+}
+
+//Returns the error described by an unsuccessful APIResponse. If our device
+//has been revoked, this is a CONFIG ProcessingError, since retrying won't
+//help.
+func responseError(apistatus *asink.APIResponse) error {
+	switch apistatus.Status {
+	case asink.SUCCESS:
+		return nil
+	case asink.REVOKED:
+		return ProcessingError{CONFIG, errors.New("Error: " + apistatus.Explanation + ". Please contact the server's administrator.")}
+	default:
+		return errors.New("API response was not success: " + apistatus.Explanation)
+	}
+}
+
+//Sets the headers asking for responses in the negotiated encoding
+func acceptNegotiated(req *http.Request, api *apiSettings, contentType string) {
+	req.Header.Set("Accept", contentType)
+	if api.gzip {
+		req.Header.Set("Accept-Encoding", asink.GZIP_ENCODING)
+	}
+}
+
+//Returns the body of resp, decompressing it if necessary
+func responseBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") == asink.GZIP_ENCODING {
+		return gzip.NewReader(resp.Body)
+	}
+	return resp.Body, nil
+}
+
+//Decodes an APIResponse from resp, in whichever encoding it was sent
+func decodeResponse(resp *http.Response, apistatus *asink.APIResponse) error {
+	body, err := responseBody(resp)
 	if err != nil {
 		return err
 	}
+	defer body.Close()
+	return asink.Decode(body, resp.Header.Get("Content-Type"), apistatus)
+}
 
+//Sends events to the server, returning the result for each one (or nil if
+//the server is too old to report them individually, in which case they were
+//all accepted)
+func actuallySendEvents(globals *AsinkGlobals, events []*asink.Event) ([]*asink.EventResult, error) {
+	api, err := getAPI(globals)
+	if err != nil {
+		return nil, err
+	}
+
+	//construct the payload
+	eventStruct := asink.EventList{
+		Events: events,
+	}
+	var buffer bytes.Buffer
+	if api.gzip {
+		gz := gzip.NewWriter(&buffer)
+		err = asink.Encode(gz, api.contentType, eventStruct)
+		gz.Close()
+	} else {
+		err = asink.Encode(&buffer, api.contentType, eventStruct)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//actually make the request
+	req, err := newAPIRequest(globals, api, "POST", api.url+"events/", api.contentType, &buffer)
+	if err != nil {
+		return nil, err
+	}
+	if api.gzip {
+		req.Header.Set("Content-Encoding", asink.GZIP_ENCODING)
+	}
+	acceptNegotiated(req, api, api.contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	//check to make sure request succeeded
 	var apistatus asink.APIResponse
-	err = json.Unmarshal(body, &apistatus)
+	err = decodeResponse(resp, &apistatus)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if apistatus.Role != 0 {
+		globals.stats.SetRole(apistatus.Role)
 	}
 	if apistatus.Status != asink.SUCCESS {
-		StatOffline()
-		return errors.New("API response was not success: " + apistatus.Explanation)
+		globals.stats.Offline()
+		return nil, responseError(&apistatus)
+	}
+	if apistatus.Results != nil && len(apistatus.Results) != len(events) {
+		return nil, errors.New("Server returned " + strconv.Itoa(len(apistatus.Results)) + " results for " + strconv.Itoa(len(events)) + " events")
 	}
 
-	StatOnline()
-	return nil
+	globals.stats.Online()
+	return apistatus.Results, nil
 }
 
 func SendEvents(globals *AsinkGlobals) {
@@ -97,7 +353,7 @@ func SendEvents(globals *AsinkGlobals) {
 		returnChans := make([]*chan error, 1)
 
 		//wait for the first event
-		request := <-sendEventsChan
+		request := <-globals.sendEventsChan
 		events[0] = request.event
 		returnChans[0] = request.returnChan
 
@@ -105,7 +361,7 @@ func SendEvents(globals *AsinkGlobals) {
 		possiblyMoreEvents := true
 		for possiblyMoreEvents && len(events) <= MAX_SEND_AT_ONCE {
 			select {
-			case request = <-sendEventsChan:
+			case request = <-globals.sendEventsChan:
 				events = append(events, request.event)
 				returnChans = append(returnChans, request.returnChan)
 			default:
@@ -114,29 +370,63 @@ func SendEvents(globals *AsinkGlobals) {
 		}
 
 		//send all these events
-		err := actuallySendEvents(globals, events)
+		results, err := actuallySendEvents(globals, events)
 
 		//send back any errors (or hopefully nil) to their respective channels
-		for _, c := range returnChans {
+		for i, c := range returnChans {
+			if err == nil && results != nil {
+				if results[i].Status == asink.CONFLICT {
+					head := results[i].Head
+					if head == nil {
+						head = &asink.Event{Type: asink.DELETE, Path: events[i].Path}
+					}
+					*c <- EventConflictError{results[i].Explanation, head}
+					continue
+				} else if results[i].Status != asink.SUCCESS {
+					*c <- EventRejectedError{results[i].Explanation}
+					continue
+				}
+				//remember the id the server gave it right away
+				events[i].Id = results[i].Id
+				events[i].LocalStatus |= asink.SENT
+			}
 			*c <- err
 		}
 	}
 }
 
 func SendEvent(globals *AsinkGlobals, event *asink.Event) error {
+	//the same UUID is sent if we have to try again, so the server doesn't
+	//add the event twice if it already received it
+	if event.UUID == "" {
+		uuid, err := util.NewUUID()
+		if err != nil {
+			return err
+		}
+		event.UUID = uuid
+	}
+	//the server fills these in too, but we need them before it sends the
+	//event back to us
+	event.Username = globals.username
+	event.Device = globals.deviceName
+
 	responseChan := make(chan error)
 	request := sendEventRequest{event, &responseChan}
-	sendEventsChan <- &request
+	globals.sendEventsChan <- &request
 	return <-responseChan
 }
 
-func GetEvents(globals *AsinkGlobals, events chan *asink.Event) {
-	url := "http://" + globals.server + ":" + strconv.Itoa(int(globals.port)) + "/events/"
+//Receives remote events and sends them to events, preferring to have the
+//server stream them to us and falling back to long polling if it can't. Waits
+//to start until the startup context closes snapshotApplied. If it can't talk
+//to the server at all (i.e. because of a configuration error), it gives up,
+//sending the error to fatalErrors.
+func GetEvents(globals *AsinkGlobals, events chan *asink.Event, snapshotApplied chan int, fatalErrors chan error) {
 	var successiveErrors uint = 0
-	StatOnline()
+	globals.stats.Online()
 
 	errorWait := func(err error) {
-		StatOffline()
+		globals.stats.Offline()
 		fmt.Println(err)
 		var waitMilliseconds time.Duration = MIN_ERROR_WAIT << successiveErrors
 		if waitMilliseconds > MAX_ERROR_WAIT {
@@ -145,59 +435,286 @@ func GetEvents(globals *AsinkGlobals, events chan *asink.Event) {
 		time.Sleep(waitMilliseconds * time.Millisecond)
 		successiveErrors++
 	}
+	connected := func() {
+		globals.stats.Online()
+		successiveErrors = 0
+	}
+	//there's no use retrying if we can't talk to the server
+	fatal := func(err error) bool {
+		if e, ok := err.(ProcessingError); ok && e.ErrorType == CONFIG {
+			globals.stats.Offline()
+			fatalErrors <- err
+			return true
+		}
+		return false
+	}
+
+	<-snapshotApplied
 
 	//query DB for latest remote event version number that we've seen locally
 	latestEvent, err := globals.db.DatabaseLatestRemoteEvent()
 	if err != nil {
 		panic(err)
 	}
+	//files not changed since the snapshot we started from have older ids
+	snapshotId, err := SnapshotId(globals)
+	if err != nil {
+		panic(err)
+	}
+	if latestEvent == nil || latestEvent.Id < snapshotId {
+		latestEvent = &asink.Event{Id: snapshotId}
+	}
 
+	streaming := true
 	for {
-		//query for events after latest_event
-		var fullUrl string
-		if latestEvent != nil {
-			fullUrl = url + strconv.FormatInt(latestEvent.Id+1, 10)
-		} else {
-			fullUrl = url + "0"
-		}
-		resp, err := AuthenticatedGet(fullUrl, globals.username, globals.password)
-
-		//if error, perform exponential backoff (with maximum timeout)
+		api, err := getAPI(globals)
 		if err != nil {
-			if resp != nil {
-				resp.Body.Close()
+			if fatal(err) {
+				return
 			}
 			errorWait(err)
 			continue
 		}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close() //must be done after the last time resp is used
-		if err != nil {
+		if streaming {
+			latestEvent, err = streamEvents(globals, api, latestEvent, events, connected)
+			if err == StreamingUnsupportedErr {
+				fmt.Println(globals.name + ": " + err.Error() + ", falling back to long polling")
+				streaming = false
+				continue
+			}
+			if fatal(err) {
+				return
+			}
+			//the connection was lost, so reconnect
 			errorWait(err)
 			continue
 		}
 
-		var apistatus asink.APIResponse
-		err = json.Unmarshal(body, &apistatus)
+		latestEvent, err = pollEvents(globals, api, latestEvent, events)
 		if err != nil {
+			if fatal(err) {
+				return
+			}
 			errorWait(err)
 			continue
 		}
-		if apistatus.Status != asink.SUCCESS {
-			errorWait(err)
-			continue
+		connected()
+	}
+}
+
+//Returns the query string asking the server for the configured number of
+//events at once, if one was configured
+func pageSizeQuery(globals *AsinkGlobals) string {
+	if globals.pageSize == 0 {
+		return ""
+	}
+	return "?limit=" + strconv.Itoa(globals.pageSize)
+}
+
+//Asks the server for events after latestEvent, waiting (up to a limit) for
+//there to be some. Returns the latest event received.
+func pollEvents(globals *AsinkGlobals, api *apiSettings, latestEvent *asink.Event, events chan *asink.Event) (*asink.Event, error) {
+	//query for events after latest_event
+	var fullUrl string
+	if latestEvent != nil {
+		fullUrl = api.url + "events/" + strconv.FormatInt(latestEvent.Id+1, 10)
+	} else {
+		fullUrl = api.url + "events/0"
+	}
+	req, err := newAPIRequest(globals, api, "GET", fullUrl+pageSizeQuery(globals), "", nil)
+	if err != nil {
+		return latestEvent, err
+	}
+	acceptNegotiated(req, api, api.contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return latestEvent, err
+	}
+	defer resp.Body.Close()
+
+	var apistatus asink.APIResponse
+	err = decodeResponse(resp, &apistatus)
+	if err != nil {
+		return latestEvent, err
+	}
+	return receiveEvents(globals, &apistatus, latestEvent, events)
+}
+
+//Streams events after latestEvent from the server, until the connection is
+//lost or the server stops sending heartbeats. Calls connected() each time
+//something is received. Returns the latest event received, and
+//StreamingUnsupportedErr if the server can't stream events.
+func streamEvents(globals *AsinkGlobals, api *apiSettings, latestEvent *asink.Event, events chan *asink.Event, connected func()) (*asink.Event, error) {
+	req, err := newAPIRequest(globals, api, "GET", api.url+"stream"+pageSizeQuery(globals), "", nil)
+	if err != nil {
+		return latestEvent, err
+	}
+	if api.contentType == asink.GOB_CONTENT_TYPE {
+		acceptNegotiated(req, api, asink.GOB_CONTENT_TYPE+", text/event-stream")
+	} else {
+		acceptNegotiated(req, api, "text/event-stream")
+	}
+	if latestEvent != nil {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(latestEvent.Id, 10))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return latestEvent, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return latestEvent, StreamingUnsupportedErr
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "text/event-stream") && !strings.HasPrefix(contentType, asink.GOB_CONTENT_TYPE) {
+		//errors are returned as regular API responses
+		var apistatus asink.APIResponse
+		if decodeResponse(resp, &apistatus) == nil && apistatus.Status != asink.SUCCESS {
+			return receiveEvents(globals, &apistatus, latestEvent, events)
 		}
+		return latestEvent, StreamingUnsupportedErr
+	}
+
+	//give up on the connection if it goes quiet for too long
+	timeout := time.AfterFunc(STREAM_TIMEOUT, func() { resp.Body.Close() })
+	defer timeout.Stop()
 
-		for _, event := range apistatus.Events {
-			if latestEvent != nil && event.Id != latestEvent.Id+1 {
-				break
+	body, err := responseBody(resp)
+	if err != nil {
+		return latestEvent, err
+	}
+
+	//each message (including heartbeats) is a gob-encoded APIResponse
+	if strings.HasPrefix(contentType, asink.GOB_CONTENT_TYPE) {
+		decoder := gob.NewDecoder(body)
+		for {
+			var apistatus asink.APIResponse
+			err = decoder.Decode(&apistatus)
+			if err != nil {
+				return latestEvent, err
+			}
+			timeout.Reset(STREAM_TIMEOUT)
+			connected()
+			latestEvent, err = receiveEvents(globals, &apistatus, latestEvent, events)
+			if err != nil {
+				return latestEvent, err
 			}
-			events <- event
-			latestEvent = event
 		}
+	}
 
-		StatOnline()
-		successiveErrors = 0
+	reader := bufio.NewReader(body)
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return latestEvent, err
+		}
+		timeout.Reset(STREAM_TIMEOUT)
+		connected()
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			//a blank line ends each message
+			if data == "" {
+				continue
+			}
+			var apistatus asink.APIResponse
+			err = json.Unmarshal([]byte(data), &apistatus)
+			data = ""
+			if err != nil {
+				return latestEvent, err
+			}
+			latestEvent, err = receiveEvents(globals, &apistatus, latestEvent, events)
+			if err != nil {
+				return latestEvent, err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data != "" {
+				data += "\n"
+			}
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+		//message ids and heartbeats (comments) need no handling, since
+		//we keep track of the latest event ourselves
+	}
+}
+
+//Retrieves the page of the share's snapshot as of the event id asOf (or its
+//latest event, if asOf is 0) which starts after the path 'after'. The
+//returned response's AsOf is the event id the snapshot was actually taken
+//as of, and an empty page means the snapshot is complete.
+func GetSnapshot(globals *AsinkGlobals, asOf int64, after string) (*asink.APIResponse, error) {
+	api, err := getAPI(globals)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if asOf > 0 {
+		query.Set("asof", strconv.FormatInt(asOf, 10))
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if globals.pageSize != 0 {
+		query.Set("limit", strconv.Itoa(globals.pageSize))
+	}
+	fullUrl := api.url + "snapshot"
+	if len(query) > 0 {
+		fullUrl += "?" + query.Encode()
+	}
+
+	req, err := newAPIRequest(globals, api, "GET", fullUrl, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	acceptNegotiated(req, api, api.contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, SnapshotUnsupportedErr
+	}
+
+	apistatus := new(asink.APIResponse)
+	err = decodeResponse(resp, apistatus)
+	if err != nil {
+		return nil, err
+	}
+	if apistatus.Role != 0 {
+		globals.stats.SetRole(apistatus.Role)
+	}
+	if apistatus.Status != asink.SUCCESS {
+		return nil, responseError(apistatus)
+	}
+	return apistatus, nil
+}
+
+//Handles a response from the server, passing along any events in it which
+//we haven't already seen. Returns the latest event received.
+func receiveEvents(globals *AsinkGlobals, apistatus *asink.APIResponse, latestEvent *asink.Event, events chan *asink.Event) (*asink.Event, error) {
+	if apistatus.Role != 0 {
+		globals.stats.SetRole(apistatus.Role)
+	}
+	if apistatus.Status != asink.SUCCESS {
+		return latestEvent, responseError(apistatus)
+	}
+
+	//event ids increase within a share, but aren't necessarily
+	//contiguous (i.e. for events created before the server supported
+	//multiple shares)
+	for _, event := range apistatus.Events {
+		if latestEvent != nil && event.Id <= latestEvent.Id {
+			continue
+		}
+		events <- event
+		latestEvent = event
 	}
+	return latestEvent, nil
 }
@@ -21,10 +21,21 @@ type pathMapValue struct {
 	remoteWaiters []chan *asink.Event
 }
 
-var pathLockerChan = make(chan *pathMapRequest)
-var pathUnlockerChan = make(chan *asink.Event)
+//Serializes access to the paths of one sync root. Run() must be running (in
+//its own goroutine) for paths to be locked or unlocked.
+type PathLocker struct {
+	lockChan   chan *pathMapRequest
+	unlockChan chan *asink.Event
+}
+
+func NewPathLocker() *PathLocker {
+	pl := new(PathLocker)
+	pl.lockChan = make(chan *pathMapRequest)
+	pl.unlockChan = make(chan *asink.Event)
+	return pl
+}
 
-func PathLocker(db *AsinkDB) {
+func (pl *PathLocker) Run(db *AsinkDB) {
 	var event *asink.Event
 	var request *pathMapRequest
 	var v *pathMapValue
@@ -34,20 +45,30 @@ func PathLocker(db *AsinkDB) {
 
 	for {
 		select {
-		case event = <-pathUnlockerChan:
+		case event = <-pl.unlockChan:
 			if v, ok = m[event.Path]; ok != false {
 				//only update status in data structures if the event hasn't been discarded
 				if event.LocalStatus&asink.DISCARDED == 0 && event.LocalStatus&asink.NOSAVE == 0 {
-					if v.latestEvent == nil || !v.latestEvent.IsSameEvent(event) {
+					if event.InDB {
+						//events which came from the database (i.e. those
+						//returned by LockPath()) can only have had their
+						//status changed
+						err := db.DatabaseUpdateEvent(event)
+						if err != nil {
+							panic(err)
+						}
+					} else if v.latestEvent == nil || !v.latestEvent.IsSameEvent(event) {
 						err := db.DatabaseAddEvent(event)
 						if err != nil {
 							panic(err)
 						}
 						//TODO batch database writes instead of doing one at a time
-					} else if v.latestEvent.Id == 0 {
+					} else if v.latestEvent.Id == 0 || v.latestEvent.LocalStatus&asink.SENT != 0 {
 						//can only get here if latestEvent exists and is the same for 'event'
 						//except for Id, so update latestEvent's Id in the database.
+						//If we sent it, it has now come back from the server.
 						v.latestEvent.Id = event.Id
+						v.latestEvent.LocalStatus &^= asink.SENT
 						event = v.latestEvent
 						err := db.DatabaseUpdateEvent(event)
 						if err != nil {
@@ -68,7 +89,7 @@ func PathLocker(db *AsinkDB) {
 					v.locked = false
 				}
 			}
-		case request = <-pathLockerChan:
+		case request = <-pl.lockChan:
 			v, ok = m[request.path]
 			//allocate pathMapValue object if it doesn't exist
 			if !ok {
@@ -97,13 +118,61 @@ func PathLocker(db *AsinkDB) {
 //'local' determines the precedence of the lock - all local lock requesters will
 //be served before any remote requesters.
 //The previous event for this path is returned, nil is returned if no previous event exists
-func LockPath(path string, local bool) (currentEvent *asink.Event) {
+func (pl *PathLocker) LockPath(path string, local bool) (currentEvent *asink.Event) {
 	c := make(chan *asink.Event)
-	pathLockerChan <- &pathMapRequest{path, local, c}
+	pl.lockChan <- &pathMapRequest{path, local, c}
 	return <-c
 }
 
 //unlocks the path, storing the updated event back to the database
-func UnlockPath(event *asink.Event) {
-	pathUnlockerChan <- event
+func (pl *PathLocker) UnlockPath(event *asink.Event) {
+	pl.unlockChan <- event
+}
+
+//Locks the path of an event and, for MOVE events, its source path as well.
+//The two paths are always locked in the same order so events touching the
+//same pair of paths can't deadlock. The latest events for each path are
+//returned, along with an event deleting the source path which must be
+//passed to UnlockEventPaths() (it is nil for events which aren't moves).
+func (pl *PathLocker) LockEventPaths(event *asink.Event, local bool) (latestLocal, latestSource, sourceEvent *asink.Event) {
+	if !event.IsMove() {
+		return pl.LockPath(event.Path, local), nil, nil
+	}
+
+	if event.SourcePath < event.Path {
+		latestSource = pl.LockPath(event.SourcePath, local)
+		latestLocal = pl.LockPath(event.Path, local)
+	} else {
+		latestLocal = pl.LockPath(event.Path, local)
+		latestSource = pl.LockPath(event.SourcePath, local)
+	}
+
+	//this is constructed only from the MOVE event itself, so that the
+	//version created when processing our own local event is the same as
+	//the one created when we see it come back from the server
+	sourceEvent = new(asink.Event)
+	sourceEvent.Id = event.Id
+	sourceEvent.Type = asink.DELETE | (event.Type & asink.DIRECTORY)
+	sourceEvent.Path = event.SourcePath
+	sourceEvent.Predecessor = event.Hash
+	sourceEvent.Timestamp = event.Timestamp
+	sourceEvent.Clock = event.Clock
+	return
+}
+
+//Unlocks the paths locked by LockEventPaths(). The source path's deletion
+//shares the fate of the event itself, unless the event stopped being a move
+//while it was being processed.
+func (pl *PathLocker) UnlockEventPaths(event, sourceEvent *asink.Event) {
+	if sourceEvent != nil {
+		if event.IsMove() {
+			sourceEvent.Id = event.Id
+			sourceEvent.Predecessor = event.Hash
+			sourceEvent.LocalStatus |= event.LocalStatus
+		} else {
+			sourceEvent.LocalStatus |= asink.DISCARDED
+		}
+		pl.UnlockPath(sourceEvent)
+	}
+	pl.UnlockPath(event)
 }
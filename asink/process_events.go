@@ -5,6 +5,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/aclindsa/asink"
 	"github.com/aclindsa/asink/util"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -74,51 +76,95 @@ func ErrorRequiresExit(err error) bool {
 	return true //if the error wasn't even a processing error, something went wrong, so we should definitely exit
 }
 
-//handle a conflict by copying the loser event to another file
-func handleConflict(globals *AsinkGlobals, loser *asink.Event, copyFrom string) error {
-	if loser.IsUpdate() {
-		//come up with new file name
-		conflictedPath := path.Join(globals.syncDir, loser.Path) + "_conflicted_copy_" + time.Now().Format("2006-01-02_15:04:05.000000")
+//Processes event with process, retrying once if the error was temporary
+func processWithRetry(globals *AsinkGlobals, event *asink.Event, process func(*AsinkGlobals, *asink.Event) error) error {
+	err := process(globals, event)
+	if e, ok := err.(ProcessingError); ok && e.ErrorType == TEMPORARY {
+		event.LocalStatus = 0
+		err = process(globals, event)
+	}
+	return err
+}
 
-		//copy file to new filename
+//Returns the name of the device event came from, suitable for use in a file
+//name, or "" if it isn't known
+func eventDeviceName(globals *AsinkGlobals, event *asink.Event) string {
+	device := event.Device
+	if device == "" && event.Id == 0 {
+		//it hasn't been sent to the server yet, so it's ours
+		device = globals.deviceName
+	}
+	return sanitizeFileName(device)
+}
+
+//Returns the name of the user who made event, or "" if it isn't known
+func eventUserName(globals *AsinkGlobals, event *asink.Event) string {
+	if event.Username == "" && event.Id == 0 {
+		return globals.username
+	}
+	return event.Username
+}
+
+//Copies the losing version of a file (from copyFrom) to a conflicted copy
+//next to it, returning the copy's path relative to the sync directory, or ""
+//if there was nothing to copy
+func handleConflict(globals *AsinkGlobals, loser *asink.Event, copyFrom string) (string, error) {
+	if loser.IsUpdate() && !loser.IsDirectory() && !loser.IsSymlink() {
 		src, err := os.Open(copyFrom)
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer src.Close()
-		sink, err := os.Create(conflictedPath)
-		if err != nil {
-			return err
+
+		//come up with new file name, saying where the losing version
+		//came from, without replacing any existing file
+		dir, base := path.Split(path.Join(globals.syncDir, loser.Path))
+		device, user, now := eventDeviceName(globals, loser), eventUserName(globals, loser), time.Now()
+		var conflictedPath string
+		var sink *os.File
+		for n := 1; ; n++ {
+			conflictedPath = path.Join(dir, conflictCopyName(globals.copyName, base, device, user, now, n))
+			sink, err = os.OpenFile(conflictedPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if err == nil {
+				break
+			} else if !os.IsExist(err) {
+				return "", err
+			}
 		}
 		defer sink.Close()
 
+		//copy file to new filename
 		_, err = io.Copy(sink, src)
-		return err
+		if err != nil {
+			return "", err
+		}
+		return filepath.Rel(globals.syncDir, conflictedPath)
 	}
-	return nil
+	return "", nil
 }
+
 func ProcessLocalEvent(globals *AsinkGlobals, event *asink.Event) error {
 	var err error
 
-	StatStartLocalUpdate()
-	defer StatStopLocalUpdate()
+	globals.stats.StartLocalUpdate()
+	defer globals.stats.StopLocalUpdate()
 
-	//make the path relative before we save/send it anywhere
+	//make the paths relative before we save/send them anywhere
 	absolutePath := event.Path
-	event.Path, err = filepath.Rel(globals.syncDir, event.Path)
+	err = makeEventPathsRelative(globals, event)
 	if err != nil {
 		return ProcessingError{TEMPORARY, err}
 	}
 
-	latestLocal := LockPath(event.Path, true)
+	latestLocal, latestSource, sourceEvent := globals.locker.LockEventPaths(event, true)
 	defer func() {
 		if err != nil {
 			event.LocalStatus |= asink.DISCARDED
 		}
-		UnlockPath(event)
+		globals.locker.UnlockEventPaths(event, sourceEvent)
 	}()
 
-	err = processLocalEvent_Upper(globals, event, latestLocal, absolutePath)
+	err = processLocalEvent_Upper(globals, event, latestLocal, latestSource, absolutePath)
 	if err != nil {
 		return err
 	}
@@ -126,62 +172,170 @@ func ProcessLocalEvent(globals *AsinkGlobals, event *asink.Event) error {
 	if event.LocalStatus&asink.DISCARDED != 0 {
 		return nil
 	}
-	err = processLocalEvent_Lower(globals, event, latestLocal)
+	err = processLocalEvent_Lower(globals, event, latestLocal, latestSource)
+	return err
+}
+
+//make an event's paths, which are absolute when they come from the watcher,
+//relative to the sync directory
+func makeEventPathsRelative(globals *AsinkGlobals, event *asink.Event) (err error) {
+	event.Path, err = filepath.Rel(globals.syncDir, event.Path)
+	if err != nil {
+		return err
+	}
+	if event.IsMove() {
+		event.SourcePath, err = filepath.Rel(globals.syncDir, event.SourcePath)
+	}
 	return err
 }
 
+//returns true if we know enough about the source of a MOVE event to treat it
+//as a move, rather than as the creation of a new file or directory
+func canMove(event *asink.Event, latestSource *asink.Event) bool {
+	return latestSource != nil && latestSource.IsUpdate() && latestSource.IsDirectory() == event.IsDirectory()
+}
+
 func ProcessLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event) error {
 	var err error
 
-	StatStartLocalUpdate()
-	defer StatStopLocalUpdate()
+	globals.stats.StartLocalUpdate()
+	defer globals.stats.StopLocalUpdate()
 
-	//make the path relative before we save/send it anywhere
+	//make the paths relative before we save/send them anywhere
 	absolutePath := event.Path
-	event.Path, err = filepath.Rel(globals.syncDir, event.Path)
+	err = makeEventPathsRelative(globals, event)
 	if err != nil {
 		return ProcessingError{TEMPORARY, err}
 	}
 
-	latestLocal := LockPath(event.Path, true)
+	latestLocal, latestSource, sourceEvent := globals.locker.LockEventPaths(event, true)
 
 	defer func() {
 		if err != nil {
 			event.LocalStatus |= asink.DISCARDED
 		}
 		event.LocalStatus |= asink.NOSAVE //make sure event doesn't get saved back until lower half
-		UnlockPath(event)
+		globals.locker.UnlockEventPaths(event, sourceEvent)
 	}()
 
-	err = processLocalEvent_Upper(globals, event, latestLocal, absolutePath)
+	err = processLocalEvent_Upper(globals, event, latestLocal, latestSource, absolutePath)
 	return err
 }
 
-func processLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event, latestLocal *asink.Event, absolutePath string) error {
+func processLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event, latestLocal *asink.Event, latestSource *asink.Event, absolutePath string) error {
+	//symbolic links are synchronized as links (or not at all) unless
+	//they're being followed, in which case they look like their targets
+	if event.IsUpdate() && !event.IsDirectory() {
+		if fileinfo, err := os.Lstat(absolutePath); err == nil && fileinfo.Mode()&os.ModeSymlink != 0 {
+			switch globals.symlinks {
+			case SYMLINKS_IGNORE:
+				event.LocalStatus |= asink.DISCARDED
+				return nil
+			case SYMLINKS_SYNC:
+				event.Type |= asink.SYMLINK
+			}
+		}
+	}
+
+	//if we never knew about the source of a move, treat it as a new file
+	if event.IsMove() && (event.IsSymlink() || !canMove(event, latestSource)) {
+		event.Type &^= asink.MOVE
+		event.SourcePath = ""
+	}
+
 	if latestLocal != nil {
 		event.Predecessor = latestLocal.Hash
 
-		if event.Timestamp < latestLocal.Timestamp {
+		if event.Before(latestLocal) {
 			fmt.Printf("trying to send event older than latestLocal:\n")
 			fmt.Printf("OLD %+v\n", latestLocal)
 			fmt.Printf("NEW %+v\n", event)
 		}
 	}
 
-	if event.IsUpdate() {
-		//copy to tmp
-		//TODO upload in chunks and check modification times to make sure it hasn't been changed instead of copying the whole thing off
-		tmpfilename, err := util.CopyToTmp(absolutePath, globals.tmpDir)
+	if event.IsUpdate() && event.IsDirectory() {
+		fileinfo, err := os.Stat(absolutePath)
 		if err != nil {
-			//bail out if the file we are trying to upload already got deleted
+			//bail out if the directory was already deleted
 			if util.ErrorFileNotFound(err) {
 				event.LocalStatus |= asink.DISCARDED
 				return nil
 			}
-			return err
+			return ProcessingError{PERMANENT, err}
+		}
+		if !fileinfo.IsDir() {
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+		event.Permissions = fileinfo.Mode()
+		event.Xattrs, err = getEventXattrs(globals, absolutePath)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
 		}
 
-		//try to collect the file's permissions
+		//directories are kept in the hash cache (without a hash) so the
+		//watcher can recognize them by their inode when they're moved
+		if event.IsMove() {
+			err = globals.db.DatabaseMoveHashCacheEntries(event.SourcePath, event.Path)
+			if err != nil {
+				return ProcessingError{TEMPORARY, err}
+			}
+		}
+		if fileStat := NewHashCacheEntry(event.Path, fileinfo); fileStat != nil {
+			err = globals.db.DatabaseSetHashCacheEntry(fileStat)
+			if err != nil {
+				return ProcessingError{TEMPORARY, err}
+			}
+		}
+
+		//squash this event if we already knew about this directory
+		if !event.IsMove() && latestLocal != nil && latestLocal.IsUpdate() && latestLocal.IsDirectory() && sameMetadata(event, latestLocal) {
+			event.LocalStatus |= asink.DISCARDED
+		}
+	} else if event.IsUpdate() && event.IsSymlink() {
+		fileinfo, err := os.Lstat(absolutePath)
+		if err == nil && fileinfo.Mode()&os.ModeSymlink == 0 {
+			//it has since been replaced, which will generate its own event
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+		var target string
+		if err == nil {
+			target, err = os.Readlink(absolutePath)
+		}
+		if err != nil {
+			//bail out if the link was already deleted
+			if util.ErrorFileNotFound(err) {
+				event.LocalStatus |= asink.DISCARDED
+				return nil
+			}
+			return ProcessingError{PERMANENT, err}
+		}
+		event.Permissions = fileinfo.Mode()
+
+		event.LinkTarget, err = relativeLinkTarget(globals, absolutePath, target)
+		if err == LinkOutsideSyncDirErr {
+			fmt.Println("Not synchronizing " + absolutePath + " because it links to " + target + ", which is outside the sync directory")
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		} else if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+
+		//whatever was here before the link may have been in the hash cache
+		err = globals.db.DatabaseRemoveHashCacheEntry(event.Path)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
+		}
+
+		//squash this event if we already knew about this link
+		if latestLocal != nil && latestLocal.IsUpdate() && latestLocal.IsSymlink() && latestLocal.LinkTarget == event.LinkTarget {
+			event.LocalStatus |= asink.DISCARDED
+		}
+	} else if event.IsUpdate() {
+		//try to collect the file's permissions (this is done before
+		//copying the file so that any modifications made while we're
+		//copying it will invalidate its hash cache entry)
 		fileinfo, err := os.Stat(absolutePath)
 		if err != nil {
 			//bail out if the file we are trying to upload already got deleted
@@ -192,6 +346,68 @@ func processLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event, latestLo
 			return ProcessingError{PERMANENT, err}
 		} else {
 			event.Permissions = fileinfo.Mode()
+			event.MTime = fileinfo.ModTime().UnixNano()
+		}
+		event.Xattrs, err = getEventXattrs(globals, absolutePath)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
+		}
+
+		//if the file hasn't changed since the last time we hashed it, and
+		//we either don't need to upload it or already have a copy of it
+		//cached, skip copying and hashing it again
+		fileStat := NewHashCacheEntry(event.Path, fileinfo)
+		if fileStat != nil {
+			cached, err := cachedHash(globals, event, fileStat)
+			if err != nil {
+				return ProcessingError{TEMPORARY, err}
+			}
+			if cached != nil && ((latestLocal != nil && cached.Hash == latestLocal.Hash) || (event.IsMove() && cached.Hash == latestSource.Hash) || isCached(globals, cached.Hash)) {
+				event.Hash = cached.Hash
+				if event.IsMove() {
+					fileStat.Hash = cached.Hash
+					err = moveHashCacheEntry(globals, event, fileStat)
+					if err != nil {
+						return ProcessingError{TEMPORARY, err}
+					}
+				} else if latestLocal != nil && event.Hash == latestLocal.Hash && sameMetadata(event, latestLocal) {
+					//If neither the file contents nor metadata changed, squash this event completely
+					event.LocalStatus |= asink.DISCARDED
+				}
+				return nil
+			}
+		}
+
+		//copy to tmp
+		//TODO upload in chunks and check modification times to make sure it hasn't been changed instead of copying the whole thing off
+		tmpfilename, fileinfo, err := copyStableToTmp(absolutePath, globals.tmpDir, fileinfo)
+		if err != nil {
+			//bail out if the file we are trying to upload already got deleted
+			if util.ErrorFileNotFound(err) {
+				event.LocalStatus |= asink.DISCARDED
+				return nil
+			}
+			//try again once it stops changing, rather than losing
+			//the change until the file is next modified
+			if err == FileChangingErr {
+				if globals.settler == nil {
+					return ProcessingError{TEMPORARY, err}
+				}
+				requeued := new(asink.Event)
+				requeued.Type = asink.UPDATE
+				requeued.Path = absolutePath
+				requeued.Timestamp = time.Now().UnixNano()
+				requeued.Clock = globals.clock.Now()
+				globals.settler.Requeue(requeued)
+				event.LocalStatus |= asink.DISCARDED
+				return nil
+			}
+			return err
+		}
+		event.Permissions = fileinfo.Mode()
+		event.MTime = fileinfo.ModTime().UnixNano()
+		if fileStat != nil {
+			fileStat = NewHashCacheEntry(event.Path, fileinfo)
 		}
 
 		//get the file's hash
@@ -201,11 +417,23 @@ func processLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event, latestLo
 		}
 		event.Hash = hash
 
+		if fileStat != nil {
+			fileStat.Hash = hash
+			if event.IsMove() {
+				err = moveHashCacheEntry(globals, event, fileStat)
+			} else {
+				err = globals.db.DatabaseSetHashCacheEntry(fileStat)
+			}
+			if err != nil {
+				return ProcessingError{TEMPORARY, err}
+			}
+		}
+
 		//If the hash is the same, don't try to upload the event again
-		if latestLocal != nil && event.Hash == latestLocal.Hash {
+		if (latestLocal != nil && event.Hash == latestLocal.Hash) || (event.IsMove() && event.Hash == latestSource.Hash) {
 			os.Remove(tmpfilename)
-			//If neither the file contents nor permissions changed, squash this event completely
-			if event.Permissions == latestLocal.Permissions {
+			//If neither the file contents nor metadata changed, squash this event completely
+			if !event.IsMove() && sameMetadata(event, latestLocal) {
 				event.LocalStatus |= asink.DISCARDED
 				return nil
 			}
@@ -222,137 +450,436 @@ func processLocalEvent_Upper(globals *AsinkGlobals, event *asink.Event, latestLo
 			}
 		}
 	} else {
-		//if we're trying to delete a file that we thought was already deleted, there's no need to delete it again
-		if latestLocal != nil && latestLocal.IsDelete() {
+		//if we're trying to delete a file that we thought was already
+		//deleted (or never knew about), there's no need to delete it again
+		if latestLocal == nil || latestLocal.IsDelete() {
 			event.LocalStatus |= asink.DISCARDED
 			return nil
 		}
+
+		//the watcher can't tell whether deleted paths were files or
+		//directories, so inherit that from what was deleted
+		if latestLocal.IsDirectory() {
+			event.Type |= asink.DIRECTORY
+		} else if latestLocal.IsSymlink() {
+			event.Type |= asink.SYMLINK
+		}
+
+		err := globals.db.DatabaseRemoveHashCacheEntry(event.Path)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
+		}
 	}
 	return nil
 }
 
+//how many times to try copying a file which keeps being modified while it's
+//being copied, and how long to wait between tries
+const COPY_TRIES = 3
+const COPY_RETRY_DELAY = 1 * time.Second
+
+var FileChangingErr = errors.New("Error: file was modified while being copied")
+
+//Copies the file at absolutePath into tmpDir, making sure it wasn't
+//modified while being copied (fileinfo is from just before copying it). If it
+//was, the copy is retried a few times before giving up. Returns the copy's
+//filename and the file's info as of when it was copied.
+func copyStableToTmp(absolutePath, tmpDir string, fileinfo os.FileInfo) (string, os.FileInfo, error) {
+	for tries := 1; ; tries++ {
+		tmpfilename, err := util.CopyToTmp(absolutePath, tmpDir)
+		if err != nil {
+			return "", nil, err
+		}
+
+		after, err := os.Stat(absolutePath)
+		if err != nil {
+			os.Remove(tmpfilename)
+			return "", nil, err
+		}
+		if after.Size() == fileinfo.Size() && after.ModTime().Equal(fileinfo.ModTime()) {
+			return tmpfilename, fileinfo, nil
+		}
+
+		os.Remove(tmpfilename)
+		if tries >= COPY_TRIES {
+			return "", nil, FileChangingErr
+		}
+		time.Sleep(COPY_RETRY_DELAY)
+		fileinfo = after
+	}
+}
+
+//Returns the cached hash entry for the file described by fileStat, or nil if
+//there isn't a valid one. For moves, the source's entry is used if it
+//describes the same file (moving a file changes its ctime, but nothing else).
+func cachedHash(globals *AsinkGlobals, event *asink.Event, fileStat *HashCacheEntry) (*HashCacheEntry, error) {
+	if event.IsMove() {
+		cached, err := globals.db.DatabaseGetHashCacheEntry(event.SourcePath)
+		if err != nil || cached == nil || !cached.SameFile(fileStat) {
+			return nil, err
+		}
+		return cached, nil
+	}
+
+	cached, err := globals.db.DatabaseGetHashCacheEntry(event.Path)
+	if err != nil || cached == nil || !cached.Matches(fileStat) {
+		return nil, err
+	}
+	return cached, nil
+}
+
+//replace the hash cache entry for a MOVE event's source with fileStat
+func moveHashCacheEntry(globals *AsinkGlobals, event *asink.Event, fileStat *HashCacheEntry) error {
+	err := globals.db.DatabaseRemoveHashCacheEntry(event.SourcePath)
+	if err != nil {
+		return err
+	}
+	return globals.db.DatabaseSetHashCacheEntry(fileStat)
+}
+
+//returns true if the file with this hash is present in the local cache
+func isCached(globals *AsinkGlobals, hash string) bool {
+	_, err := os.Stat(path.Join(globals.cacheDir, hash))
+	return err == nil
+}
+
+//record the hash of a file we've just written out so it doesn't have to be
+//re-hashed the next time it is seen by the watcher
+func updateHashCache(globals *AsinkGlobals, event *asink.Event, absolutePath string) error {
+	fileinfo, err := os.Stat(absolutePath)
+	if err != nil {
+		return err
+	}
+	fileStat := NewHashCacheEntry(event.Path, fileinfo)
+	if fileStat == nil {
+		return nil
+	}
+	fileStat.Hash = event.Hash
+	return globals.db.DatabaseSetHashCacheEntry(fileStat)
+}
+
 func ProcessLocalEvent_Lower(globals *AsinkGlobals, event *asink.Event) error {
 	var err error
 
-	StatStartLocalUpdate()
-	defer StatStopLocalUpdate()
+	globals.stats.StartLocalUpdate()
+	defer globals.stats.StopLocalUpdate()
 
-	latestLocal := LockPath(event.Path, true)
+	latestLocal, latestSource, sourceEvent := globals.locker.LockEventPaths(event, true)
 	defer func() {
 		if err != nil {
 			event.LocalStatus |= asink.DISCARDED
 		}
 		event.LocalStatus &= ^asink.NOSAVE //clear NOSAVE set in upper half
-		UnlockPath(event)
+		globals.locker.UnlockEventPaths(event, sourceEvent)
 	}()
 
-	err = processLocalEvent_Lower(globals, event, latestLocal)
+	err = processLocalEvent_Lower(globals, event, latestLocal, latestSource)
 	return err
 }
 
-func processLocalEvent_Lower(globals *AsinkGlobals, event *asink.Event, latestLocal *asink.Event) error {
+func processLocalEvent_Lower(globals *AsinkGlobals, event *asink.Event, latestLocal *asink.Event, latestSource *asink.Event) error {
 	var err error
 
+	//if the source of a move was deleted out from under us, we can no
+	//longer claim to have moved it
+	if event.IsMove() && !canMove(event, latestSource) {
+		event.Type &^= asink.MOVE
+		event.SourcePath = ""
+		if event.IsDirectory() {
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+	}
+
 	//if we already have this event, or if it is older than our most recent event, bail out
 	if latestLocal != nil {
-		if event.Timestamp < latestLocal.Timestamp {
+		if event.Before(latestLocal) {
 			event.LocalStatus |= asink.DISCARDED
 			return nil
 		}
 
-		//if the remote side snuck in an event that has the same hash
-		//as we do, disregard our event
-		if event.Hash == latestLocal.Hash {
+		//if the remote side snuck in an event that has the same
+		//contents as ours, disregard our event
+		if sameContents(event, latestLocal) {
 			event.LocalStatus |= asink.DISCARDED
 			return nil
 		}
 
 		//if our predecessor has changed, it means we have received a
 		//remote event for this file since the top half of processing
-		//this local event. If this is true, we have a conflict we
-		//can't resolve without user intervention.
+		//this local event, which has already replaced our version on
+		//disk, so we have a conflict to settle
 		if latestLocal.Hash != event.Predecessor {
-			err = handleConflict(globals, event, path.Join(globals.cacheDir, event.Hash))
-			event.LocalStatus |= asink.DISCARDED
+			localWins, merged, err := settleConflict(globals, event, latestLocal, path.Join(globals.cacheDir, event.Hash))
 			if err != nil {
+				event.LocalStatus |= asink.DISCARDED
 				return ProcessingError{PERMANENT, err}
 			}
-			return nil
+			if !localWins {
+				event.LocalStatus |= asink.DISCARDED
+				return nil
+			}
+			if merged != "" {
+				event.Hash = merged
+			}
+			err = restoreLocalVersion(globals, event)
+			if err != nil {
+				event.LocalStatus |= asink.DISCARDED
+				return ProcessingError{PERMANENT, err}
+			}
+			event.Predecessor = latestLocal.Hash
+			//make sure it is ordered after the version it replaces
+			globals.clock.Observe(latestLocal.Clock)
+			event.Clock = globals.clock.Now()
 		}
 	}
 
-	if event.IsUpdate() {
-		//upload file to remote storage
-		StatStartUpload()
-		done := make(chan error, 1)
-		uploadWriteCloser, err := globals.storage.Put(event.Hash, done)
+	//members with read-only access to a share can't change it, so the
+	//change stays local (and will be treated as a conflict if the file is
+	//changed remotely)
+	if globals.stats.ReadOnly() {
+		refuseLocalEvent(globals, event)
+		return nil
+	}
+
+	//files which were only moved, or whose metadata alone changed, have
+	//already been uploaded
+	if event.IsUpdate() && !event.IsDirectory() && !event.IsSymlink() && !(event.IsMove() && event.Hash == latestSource.Hash) && !(latestLocal != nil && event.Hash == latestLocal.Hash) {
+		err = uploadEvent(globals, event)
 		if err != nil {
-			return ProcessingError{STORAGE, err}
+			return err
 		}
+	}
+
+	//finally, send it off to the server
+	for {
+		globals.stats.StartSending()
+		err = SendEvent(globals, event)
+		globals.stats.StopSending()
 
-		cachedFilename := path.Join(globals.cacheDir, event.Hash)
-		uploadFile, err := os.Open(cachedFilename)
+		//someone else changed this path first, so we have a conflict to
+		//settle. If our version wins, it is sent again as a change to
+		//theirs (which we ignore when it reaches us), otherwise theirs
+		//replaces ours when it reaches us.
+		conflict, ok := err.(EventConflictError)
+		if !ok {
+			break
+		}
+		localWins, merged, err := settleConflict(globals, event, conflict.Head, path.Join(globals.cacheDir, event.Hash))
 		if err != nil {
-			uploadWriteCloser.Close()
-			return ProcessingError{STORAGE, err}
+			event.LocalStatus |= asink.DISCARDED
+			return ProcessingError{PERMANENT, err}
 		}
-
-		if globals.encrypted {
-			encrypter, err := NewEncrypter(uploadWriteCloser, globals.key)
+		if !localWins {
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+		//the merged version replaces ours, both here and on the server
+		if merged != "" {
+			event.Hash = merged
+			err = restoreLocalVersion(globals, event)
 			if err != nil {
-				uploadWriteCloser.Close()
-				uploadFile.Close()
-				return ProcessingError{STORAGE, err}
+				event.LocalStatus |= asink.DISCARDED
+				return ProcessingError{PERMANENT, err}
+			}
+			err = uploadEvent(globals, event)
+			if err != nil {
+				return err
 			}
-			_, err = io.Copy(encrypter, uploadFile)
-			encrypter.Close()
-		} else {
-			_, err = io.Copy(uploadWriteCloser, uploadFile)
 		}
-		uploadFile.Close()
-		uploadWriteCloser.Close()
+		event.Predecessor = conflict.Head.Hash
+		globals.clock.Observe(conflict.Head.Clock)
+		event.Clock = globals.clock.Now()
+	}
+	if err != nil {
+		//this may be how we find out we only have read-only access
+		if globals.stats.ReadOnly() {
+			refuseLocalEvent(globals, event)
+			return nil
+		}
+		if _, ok := err.(EventRejectedError); ok {
+			fmt.Println("Warning: not synchronizing local change to " + event.Path + ": " + err.Error())
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+		if _, ok := err.(ProcessingError); ok {
+			return err
+		}
+		return ProcessingError{NETWORK, err}
+	}
 
-		//ensure the upload is observable by other clients before proceeding
-		err = <-done
+	//the server only knows about the directory itself being moved, so
+	//make sure we remember its contents were moved along with it
+	if event.IsMove() && event.IsDirectory() {
+		err = moveTrackedChildren(globals, event, false)
 		if err != nil {
-			return ProcessingError{STORAGE, err}
+			return ProcessingError{PERMANENT, err}
 		}
+	}
+	return nil
+}
 
-		StatStopUpload()
-		if err != nil {
-			return ProcessingError{STORAGE, err}
+//Warns that a local event won't be sent to the server because we only have
+//read-only access to the share
+func refuseLocalEvent(globals *AsinkGlobals, event *asink.Event) {
+	fmt.Println("Warning: not synchronizing local change to " + event.Path + " because you have read-only access to share '" + globals.share + "'")
+	globals.stats.RefusedUpdate()
+	event.LocalStatus |= asink.DISCARDED
+}
+
+//Record the contents of a moved directory as having been moved along with
+//it. If renameOnDisk is true, each file is also renamed individually (this is
+//used when the directory couldn't simply be renamed as a whole).
+func moveTrackedChildren(globals *AsinkGlobals, event *asink.Event, renameOnDisk bool) error {
+	children, err := globals.db.DatabaseGetTrackedChildren(event.SourcePath)
+	if err != nil {
+		return err
+	}
+
+	var events []*asink.Event
+	for _, child := range children {
+		//each child keeps the id of the event which made its version,
+		//but is ordered after the move
+		moved := *child
+		moved.Path = event.Path + strings.TrimPrefix(child.Path, event.SourcePath)
+		moved.LocalId = 0
+		moved.InDB = false
+		moved.LocalStatus = (child.LocalStatus|event.LocalStatus)&asink.SKIPPED | child.LocalStatus&asink.SENT
+		if moved.Timestamp < event.Timestamp {
+			moved.Timestamp = event.Timestamp
+		}
+		if moved.Clock < event.Clock {
+			moved.Clock = event.Clock
+		}
+
+		//while its old path was emptied by the move itself
+		deleted := new(asink.Event)
+		deleted.Id = event.Id
+		deleted.Type = asink.DELETE | (child.Type & asink.DIRECTORY)
+		deleted.Path = child.Path
+		deleted.Predecessor = child.Hash
+		deleted.Timestamp = moved.Timestamp
+		deleted.Clock = moved.Clock
+		deleted.LocalStatus = event.LocalStatus & asink.SENT
+
+		if renameOnDisk {
+			newPath := path.Join(globals.syncDir, moved.Path)
+			if child.IsDirectory() {
+				util.EnsureDirExists(newPath)
+			} else if util.EnsureDirExists(path.Dir(newPath)) == nil {
+				os.Rename(path.Join(globals.syncDir, child.Path), newPath)
+			}
 		}
+		events = append(events, deleted, &moved)
 	}
 
-	//finally, send it off to the server
-	StatStartSending()
-	err = SendEvent(globals, event)
-	StatStopSending()
+	err = globals.db.DatabaseAddEvents(events)
 	if err != nil {
-		return ProcessingError{NETWORK, err}
+		return err
+	}
+
+	if renameOnDisk {
+		//remove the now-empty directories, deepest first
+		for i := len(children) - 1; i >= 0; i-- {
+			if children[i].IsDirectory() {
+				os.Remove(path.Join(globals.syncDir, children[i].Path))
+			}
+		}
+		os.Remove(path.Join(globals.syncDir, event.SourcePath))
+	}
+	return globals.db.DatabaseMoveHashCacheEntries(event.SourcePath, event.Path)
+}
+
+//returns true if both events leave the same thing, with the same metadata,
+//at their path
+func sameContents(e1 *asink.Event, e2 *asink.Event) bool {
+	if !sameMetadata(e1, e2) {
+		return false
+	}
+	if e1.IsDirectory() || e1.IsSymlink() || e2.IsDirectory() || e2.IsSymlink() {
+		return e1.Type&^asink.MOVE == e2.Type&^asink.MOVE && e1.LinkTarget == e2.LinkTarget
+	}
+	return e1.Hash == e2.Hash
+}
+
+//Returns true if event is a change to latestLocal, our latest version of its
+//path. It also is if its predecessor is a version we never received, since
+//the server drops old versions when compacting its events: if ours had
+//already been accepted by the server (so we have no unsent change to it),
+//and this one was accepted after it, it can only have followed on from ours.
+func followsLatest(globals *AsinkGlobals, latestLocal, event *asink.Event) (bool, error) {
+	if latestLocal.Hash == event.Predecessor || latestLocal.Hash == event.Hash {
+		return true, nil
+	}
+	if latestLocal.Id == 0 || event.Id <= latestLocal.Id {
+		return false, nil
+	}
+	history, err := globals.db.DatabaseGetHistory(event.Path)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range history {
+		if e.Id != 0 && e.Hash == event.Predecessor {
+			//we received its predecessor, so it wasn't dropped
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//Queues a change of type eventType to the file at absolutePath to be
+//processed and sent as if the watcher had just noticed it
+func resendLocal(globals *AsinkGlobals, absolutePath string, eventType asink.EventType) {
+	event := new(asink.Event)
+	event.Type = eventType
+	event.Path = absolutePath
+	event.Timestamp = time.Now().UnixNano()
+	event.Clock = globals.clock.Now()
+	if globals.settler != nil {
+		globals.settler.PassLater(event)
+	} else {
+		go func() { globals.localUpdates <- event }()
 	}
-	return nil
 }
 
 func ProcessRemoteEvent(globals *AsinkGlobals, event *asink.Event) error {
 	var err error
 
-	StatStartRemoteUpdate()
-	defer StatStopRemoteUpdate()
-	latestLocal := LockPath(event.Path, false)
+	globals.stats.StartRemoteUpdate()
+	defer globals.stats.StopRemoteUpdate()
+
+	//changes we make from now on happened after this one
+	globals.clock.Observe(event.Clock)
+
+	latestLocal, latestSource, sourceEvent := globals.locker.LockEventPaths(event, false)
 	defer func() {
 		if err != nil {
 			event.LocalStatus |= asink.DISCARDED
 		}
-		UnlockPath(event)
+		globals.locker.UnlockEventPaths(event, sourceEvent)
 	}()
 
+	//events outside the selected subtrees are only tracked
+	if !globals.selection.Selected(event.Path) {
+		event.LocalStatus |= asink.SKIPPED
+		if event.IsMove() {
+			err = processRemoteMoveOutOfSelection(globals, event, latestSource)
+		}
+		return err
+	}
+
+	//leave local copies of ignored files alone
+	if globals.ignore.Ignored(event.Path, event.IsDirectory()) {
+		event.LocalStatus |= asink.DISCARDED
+		return nil
+	}
+
 	//get the absolute path because we may need it later
 	absolutePath := path.Join(globals.syncDir, event.Path)
 
 	//if we already have this event, or if it is older than our most recent event, bail out
 	if latestLocal != nil {
-		if event.Timestamp < latestLocal.Timestamp {
+		if event.Before(latestLocal) {
 			event.LocalStatus |= asink.DISCARDED
 			return nil
 		}
@@ -360,91 +887,429 @@ func ProcessRemoteEvent(globals *AsinkGlobals, event *asink.Event) error {
 			return nil
 		}
 
-		if latestLocal.Hash != event.Predecessor && latestLocal.Hash != event.Hash {
-			err = handleConflict(globals, latestLocal, path.Join(globals.cacheDir, latestLocal.Hash))
+		//the server received our version after this one, so it has
+		//already replaced this one
+		if latestLocal.Id > event.Id {
+			event.LocalStatus |= asink.DISCARDED
+			return nil
+		}
+
+		var follows bool
+		follows, err = followsLatest(globals, latestLocal, event)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
+		}
+		if !follows {
+			var localWins bool
+			var merged string
+			localWins, merged, err = settleConflict(globals, latestLocal, event, path.Join(globals.cacheDir, latestLocal.Hash))
 			if err != nil {
 				return ProcessingError{PERMANENT, err}
 			}
+			//remember this version without letting it replace ours,
+			//and make sure ours (or the version merged from both) is
+			//sent again as a change to this one
+			if localWins {
+				if merged != "" {
+					err = replaceFile(globals, path.Join(globals.cacheDir, merged), absolutePath, latestLocal.Permissions)
+					if err != nil {
+						return ProcessingError{PERMANENT, err}
+					}
+				}
+				if latestLocal.IsDelete() && merged == "" {
+					resendLocal(globals, absolutePath, asink.DELETE)
+				} else {
+					resendLocal(globals, absolutePath, asink.UPDATE)
+				}
+				return nil
+			}
 		}
 	}
 
-	//Download event
-	if event.IsUpdate() {
-		if latestLocal == nil || event.Hash != latestLocal.Hash {
+	//try to satisfy moves by renaming our own copy of the source
+	moved := false
+	if event.IsMove() {
+		moved, err = processRemoteMove(globals, event, latestSource, sourceEvent, absolutePath)
+		if err != nil {
+			return err
+		}
+	}
 
-			outfile, err := ioutil.TempFile(globals.tmpDir, "asink")
+	if event.IsDirectory() {
+		if !moved {
+			err = processRemoteDirectoryEvent(globals, event, absolutePath)
 			if err != nil {
-				return ProcessingError{CONFIG, err}
+				return err
 			}
-			tmpfilename := outfile.Name()
-			StatStartDownload()
-			downloadReadCloser, err := globals.storage.Get(event.Hash)
+		}
+		if event.IsMove() {
+			err = moveTrackedChildren(globals, event, !moved)
 			if err != nil {
-				StatStopDownload()
-				return ProcessingError{STORAGE, err}
-			}
-			defer downloadReadCloser.Close()
-			if globals.encrypted {
-				decrypter, err := NewDecrypter(downloadReadCloser, globals.key)
-				if err != nil {
-					StatStopDownload()
-					return ProcessingError{STORAGE, err}
-				}
-				_, err = io.Copy(outfile, decrypter)
-			} else {
-				_, err = io.Copy(outfile, downloadReadCloser)
+				return ProcessingError{PERMANENT, err}
 			}
-
-			outfile.Close()
-			StatStopDownload()
+			//anything moved here from outside the selected subtrees
+			//hasn't been downloaded yet
+			err = materializeChildren(globals, event.Path)
 			if err != nil {
-				return ProcessingError{STORAGE, err}
+				return err
 			}
+		}
+		return nil
+	}
 
-			//rename to local hashed filename
-			hashedFilename := path.Join(globals.cacheDir, event.Hash)
-			err = os.Rename(tmpfilename, hashedFilename)
+	if event.IsSymlink() {
+		err = processRemoteSymlinkEvent(globals, event, absolutePath)
+		if err != nil {
+			return err
+		}
+		if event.IsDelete() {
+			removeDeletedParentDirs(globals, event.Path)
+		}
+		return nil
+	}
+
+	//Download event
+	if event.IsUpdate() {
+		if !moved && (latestLocal == nil || event.Hash != latestLocal.Hash) {
+			err = downloadEvent(globals, event, absolutePath)
 			if err != nil {
-				err = os.Remove(tmpfilename)
-				if err != nil {
-					return ProcessingError{PERMANENT, err}
-				}
+				return err
+			}
+		}
+		if moved || latestLocal == nil || event.Hash != latestLocal.Hash || !sameMetadata(event, latestLocal) {
+			err = os.Chmod(absolutePath, event.Permissions)
+			if err != nil && !util.ErrorFileNotFound(err) {
 				return ProcessingError{PERMANENT, err}
 			}
-
-			//copy hashed file to another tmp, then rename it to the actual file.
-			tmpfilename, err = util.CopyToTmp(hashedFilename, globals.tmpDir)
-			if err != nil {
+			err = setEventMetadata(globals, event, absolutePath)
+			if err != nil && !util.ErrorFileNotFound(err) {
 				return ProcessingError{PERMANENT, err}
 			}
 
-			//make sure containing directory exists
-			err = util.EnsureDirExists(path.Dir(absolutePath))
+			err = updateHashCache(globals, event, absolutePath)
+			if err != nil && !util.ErrorFileNotFound(err) {
+				return ProcessingError{TEMPORARY, err}
+			}
+		}
+
+		//if we had to download the destination of a move, the source may
+		//still need removing
+		if event.IsMove() && !moved && sourceEvent.LocalStatus&asink.DISCARDED == 0 {
+			err = globals.db.DatabaseRemoveHashCacheEntry(event.SourcePath)
 			if err != nil {
-				return ProcessingError{PERMANENT, err}
+				return ProcessingError{TEMPORARY, err}
 			}
+			os.Remove(path.Join(globals.syncDir, event.SourcePath))
+			removeDeletedParentDirs(globals, event.SourcePath)
+		}
+	} else {
+		err = globals.db.DatabaseRemoveHashCacheEntry(event.Path)
+		if err != nil {
+			return ProcessingError{TEMPORARY, err}
+		}
+
+		//intentionally ignore errors in case this file has been deleted out from under us
+		os.Remove(absolutePath)
+		removeDeletedParentDirs(globals, event.Path)
+	}
 
-			err = os.Rename(tmpfilename, absolutePath)
+	return nil
+}
+
+//Attempts to carry out a remote MOVE event by renaming the local copy of its
+//source. Returns false if this wasn't possible, in which case the
+//destination must be created from scratch.
+func processRemoteMove(globals *AsinkGlobals, event *asink.Event, latestSource *asink.Event, sourceEvent *asink.Event, absolutePath string) (bool, error) {
+	if !canMove(event, latestSource) || (!event.IsDirectory() && latestSource.Hash != event.Hash) {
+		//if the source has local changes the server hasn't seen yet, keep
+		//it around rather than losing them
+		if latestSource != nil && latestSource.IsUpdate() && latestSource.Id == 0 {
+			sourceEvent.LocalStatus |= asink.DISCARDED
+		}
+		return false, nil
+	}
+
+	sourcePath := path.Join(globals.syncDir, event.SourcePath)
+	fileinfo, err := os.Lstat(sourcePath)
+	if err != nil || fileinfo.IsDir() != event.IsDirectory() {
+		return false, nil
+	}
+
+	err = util.EnsureDirExists(path.Dir(absolutePath))
+	if err != nil {
+		return false, ProcessingError{PERMANENT, err}
+	}
+	//this fails if the destination is a non-empty directory, in which
+	//case we fall back to moving the contents individually
+	err = os.Rename(sourcePath, absolutePath)
+	if err != nil {
+		return false, nil
+	}
+	removeDeletedParentDirs(globals, event.SourcePath)
+
+	err = globals.db.DatabaseMoveHashCacheEntries(event.SourcePath, event.Path)
+	if err != nil {
+		return true, ProcessingError{TEMPORARY, err}
+	}
+	return true, nil
+}
+
+//Handles a remote MOVE whose destination isn't selected. If the source was,
+//our copy of it must be removed since it has moved out of view.
+func processRemoteMoveOutOfSelection(globals *AsinkGlobals, event *asink.Event, latestSource *asink.Event) error {
+	if latestSource != nil && latestSource.IsUpdate() && latestSource.LocalStatus&asink.SKIPPED == 0 {
+		var err error
+		if latestSource.IsDirectory() {
+			err = dematerializeTree(globals, latestSource)
+		} else {
+			err = dematerialize(globals, latestSource)
+		}
+		if err != nil {
+			return err
+		}
+		removeDeletedParentDirs(globals, event.SourcePath)
+	}
+	if event.IsDirectory() {
+		err := moveTrackedChildren(globals, event, false)
+		if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+	}
+	return nil
+}
+
+//Uploads the cached copy of event's file to remote storage
+func uploadEvent(globals *AsinkGlobals, event *asink.Event) error {
+	globals.stats.StartUpload()
+	done := make(chan error, 1)
+	uploadWriteCloser, err := globals.storage.Put(event.Hash, done)
+	if err != nil {
+		return ProcessingError{STORAGE, err}
+	}
+
+	cachedFilename := path.Join(globals.cacheDir, event.Hash)
+	uploadFile, err := os.Open(cachedFilename)
+	if err != nil {
+		uploadWriteCloser.Close()
+		return ProcessingError{STORAGE, err}
+	}
+
+	if globals.encrypted {
+		encrypter, err := NewEncrypter(uploadWriteCloser, globals.key)
+		if err != nil {
+			uploadWriteCloser.Close()
+			uploadFile.Close()
+			return ProcessingError{STORAGE, err}
+		}
+		_, err = io.Copy(encrypter, uploadFile)
+		encrypter.Close()
+	} else {
+		_, err = io.Copy(uploadWriteCloser, uploadFile)
+	}
+	uploadFile.Close()
+	uploadWriteCloser.Close()
+
+	//ensure the upload is observable by other clients before proceeding
+	err = <-done
+	if err != nil {
+		return ProcessingError{STORAGE, err}
+	}
+
+	globals.stats.StopUpload()
+	if err != nil {
+		return ProcessingError{STORAGE, err}
+	}
+	return nil
+}
+
+//download the file for an event from storage and put it in place
+func downloadEvent(globals *AsinkGlobals, event *asink.Event, absolutePath string) error {
+	err := downloadToCache(globals, event.Hash)
+	if err != nil {
+		return err
+	}
+
+	//copy hashed file to another tmp, then rename it to the actual file.
+	hashedFilename := path.Join(globals.cacheDir, event.Hash)
+	tmpfilename, err := util.CopyToTmp(hashedFilename, globals.tmpDir)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+
+	//make sure containing directory exists
+	err = util.EnsureDirExists(path.Dir(absolutePath))
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+
+	err = os.Rename(tmpfilename, absolutePath)
+	if err != nil {
+		err2 := os.Remove(tmpfilename)
+		if err2 != nil {
+			return ProcessingError{PERMANENT, err2}
+		}
+		return ProcessingError{PERMANENT, err}
+	}
+	return nil
+}
+
+//Downloads the file with the given hash from remote storage into the cache
+func downloadToCache(globals *AsinkGlobals, hash string) error {
+	outfile, err := ioutil.TempFile(globals.tmpDir, "asink")
+	if err != nil {
+		return ProcessingError{CONFIG, err}
+	}
+	tmpfilename := outfile.Name()
+	globals.stats.StartDownload()
+	downloadReadCloser, err := globals.storage.Get(hash)
+	if err != nil {
+		globals.stats.StopDownload()
+		return ProcessingError{STORAGE, err}
+	}
+	defer downloadReadCloser.Close()
+	if globals.encrypted {
+		decrypter, err := NewDecrypter(downloadReadCloser, globals.key)
+		if err != nil {
+			globals.stats.StopDownload()
+			return ProcessingError{STORAGE, err}
+		}
+		_, err = io.Copy(outfile, decrypter)
+	} else {
+		_, err = io.Copy(outfile, downloadReadCloser)
+	}
+
+	outfile.Close()
+	globals.stats.StopDownload()
+	if err != nil {
+		return ProcessingError{STORAGE, err}
+	}
+
+	//rename to local hashed filename
+	hashedFilename := path.Join(globals.cacheDir, hash)
+	err = os.Rename(tmpfilename, hashedFilename)
+	if err != nil {
+		err = os.Remove(tmpfilename)
+		if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+		return ProcessingError{PERMANENT, err}
+	}
+	return nil
+}
+
+func processRemoteDirectoryEvent(globals *AsinkGlobals, event *asink.Event, absolutePath string) error {
+	if event.IsUpdate() {
+		//remove any file that used to be at this path
+		if fileinfo, err := os.Lstat(absolutePath); err == nil && !fileinfo.IsDir() {
+			err = os.Remove(absolutePath)
 			if err != nil {
-				err2 := os.Remove(tmpfilename)
-				if err2 != nil {
-					return ProcessingError{PERMANENT, err2}
-				}
 				return ProcessingError{PERMANENT, err}
 			}
 		}
-		if latestLocal == nil || event.Hash != latestLocal.Hash || event.Permissions != latestLocal.Permissions {
-			err = os.Chmod(absolutePath, event.Permissions)
+
+		err := util.EnsureDirExists(absolutePath)
+		if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+		err = os.Chmod(absolutePath, event.Permissions)
+		if err != nil && !util.ErrorFileNotFound(err) {
+			return ProcessingError{PERMANENT, err}
+		}
+		err = setEventMetadata(globals, event, absolutePath)
+		if err != nil && !util.ErrorFileNotFound(err) {
+			return ProcessingError{PERMANENT, err}
+		}
+
+		err = updateHashCache(globals, event, absolutePath)
+		if err != nil && !util.ErrorFileNotFound(err) {
+			return ProcessingError{TEMPORARY, err}
+		}
+	} else {
+		//This will fail if the directory still has contents (i.e. the
+		//deletion events for its files haven't been processed yet). In
+		//that case, removeDeletedParentDirs() will clean it up once the
+		//last of them is.
+		os.Remove(absolutePath)
+	}
+	return nil
+}
+
+func processRemoteSymlinkEvent(globals *AsinkGlobals, event *asink.Event, absolutePath string) error {
+	if event.IsDelete() {
+		//leave alone anything which has replaced the link locally
+		if fileinfo, err := os.Lstat(absolutePath); err == nil && fileinfo.Mode()&os.ModeSymlink != 0 {
+			err = os.Remove(absolutePath)
 			if err != nil && !util.ErrorFileNotFound(err) {
 				return ProcessingError{PERMANENT, err}
 			}
 		}
-	} else {
-		//intentionally ignore errors in case this file has been deleted out from under us
-		os.Remove(absolutePath)
-		//delete the directory previously containing this file if its the last file
-		util.RecursiveRemoveEmptyDirs(path.Dir(absolutePath))
+		return nil
+	}
+
+	if globals.symlinks == SYMLINKS_IGNORE {
+		return nil
 	}
 
+	//never create links which point outside the sync directory
+	if filepath.IsAbs(event.LinkTarget) {
+		fmt.Println("Not creating " + absolutePath + " because it links to the absolute path " + event.LinkTarget)
+		return nil
+	}
+	if _, err := relativeLinkTarget(globals, absolutePath, event.LinkTarget); err != nil {
+		fmt.Println("Not creating " + absolutePath + " because it links to " + event.LinkTarget + ", which is outside the sync directory")
+		return nil
+	}
+
+	//remove any (empty) directory that used to be at this path
+	if fileinfo, err := os.Lstat(absolutePath); err == nil && fileinfo.IsDir() {
+		err = os.Remove(absolutePath)
+		if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+	}
+
+	err := util.EnsureDirExists(path.Dir(absolutePath))
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+
+	//create the link under a temporary name, then rename it into place
+	tmpfile, err := ioutil.TempFile(globals.tmpDir, "asink")
+	if err != nil {
+		return ProcessingError{CONFIG, err}
+	}
+	tmpfilename := tmpfile.Name()
+	tmpfile.Close()
+	os.Remove(tmpfilename)
+	err = os.Symlink(event.LinkTarget, tmpfilename)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+	err = os.Rename(tmpfilename, absolutePath)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return ProcessingError{PERMANENT, err}
+	}
+
+	err = globals.db.DatabaseRemoveHashCacheEntry(event.Path)
+	if err != nil {
+		return ProcessingError{TEMPORARY, err}
+	}
 	return nil
 }
+
+//Remove the directories containing a deleted file if they are empty and
+//have themselves been deleted. Directories we have no record of are removed
+//as long as they are empty, since they were created implicitly.
+func removeDeletedParentDirs(globals *AsinkGlobals, relativePath string) {
+	for dir := path.Dir(relativePath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		latest, err := globals.db.DatabaseLatestEventForPath(dir)
+		if err != nil || (latest != nil && !latest.IsDelete()) {
+			return
+		}
+		err = os.Remove(path.Join(globals.syncDir, dir))
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,306 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"code.google.com/p/goconf/conf"
+	"errors"
+	"github.com/aclindsa/asink"
+	"github.com/aclindsa/asink/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//name of the sync root configured by the unprefixed sections of the config
+//file, which is the only one used if [local] roots isn't specified
+const DEFAULT_ROOT = "default"
+
+//Reads the options for one sync root from the config file. A root named
+//'work' looks for its options in sections named [work/local],
+//[work/server], etc. before falling back to the unprefixed sections, which
+//are the only ones the default root uses.
+type RootConfig struct {
+	config *conf.ConfigFile
+	name   string
+}
+
+func (rc *RootConfig) section(section, option string) string {
+	if rc.name != DEFAULT_ROOT && rc.config.HasOption(rc.name+"/"+section, option) {
+		return rc.name + "/" + section
+	}
+	return section
+}
+
+func (rc *RootConfig) GetString(section, option string) (string, error) {
+	return rc.config.GetString(rc.section(section, option), option)
+}
+
+func (rc *RootConfig) GetInt(section, option string) (int, error) {
+	return rc.config.GetInt(rc.section(section, option), option)
+}
+
+func (rc *RootConfig) GetBool(section, option string) (bool, error) {
+	return rc.config.GetBool(rc.section(section, option), option)
+}
+
+//Sets up all the sync roots named in the config file
+func LoadRoots(config *conf.ConfigFile) ([]*AsinkGlobals, error) {
+	names := []string{DEFAULT_ROOT}
+	if rootList, err := config.GetString("local", "roots"); err == nil {
+		names = nil
+		for _, name := range strings.Split(rootList, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var roots []*AsinkGlobals
+	dbLocations := make(map[string]string)
+	for _, name := range names {
+		rc := &RootConfig{config, name}
+
+		//two roots can't share a database or overlap on disk
+		dbLocation, err := rc.GetString("local", "dblocation")
+		if err != nil {
+			return nil, errors.New("Error: database location not specified in config file for sync root '" + name + "'.")
+		}
+		if other, ok := dbLocations[dbLocation]; ok {
+			return nil, errors.New("Error: sync roots '" + other + "' and '" + name + "' are configured to use the same database.")
+		}
+		dbLocations[dbLocation] = name
+
+		root, err := LoadRoot(rc)
+		if err != nil {
+			return nil, errors.New(err.Error() + " (while loading sync root '" + name + "')")
+		}
+		for _, other := range roots {
+			if root.syncDir == other.syncDir || strings.HasPrefix(root.syncDir, other.syncDir+"/") || strings.HasPrefix(other.syncDir, root.syncDir+"/") {
+				return nil, errors.New("Error: the sync directories of sync roots '" + other.name + "' and '" + name + "' overlap.")
+			}
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+//Sets up the sync root described by rc, creating its directories and
+//opening its database
+func LoadRoot(rc *RootConfig) (*AsinkGlobals, error) {
+	var err error
+	globals := new(AsinkGlobals)
+	globals.name = rc.name
+	globals.stats = new(Stats)
+	globals.locker = NewPathLocker()
+	globals.sendEventsChan = make(chan *sendEventRequest)
+
+	globals.storage, err = GetStorage(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	globals.syncDir, err = rc.GetString("local", "syncdir")
+	globals.cacheDir, err = rc.GetString("local", "cachedir")
+	globals.tmpDir, err = rc.GetString("local", "tmpdir")
+	globals.syncDir = filepath.Clean(globals.syncDir)
+
+	//by default, every subtree is selected
+	var include, exclude []string
+	if includeList, err := rc.GetString("local", "include"); err == nil {
+		include = strings.Split(includeList, ",")
+	}
+	if excludeList, err := rc.GetString("local", "exclude"); err == nil {
+		exclude = strings.Split(excludeList, ",")
+	}
+	globals.selection = NewSelection(include, exclude)
+
+	//by default, both versions of a conflicted file are kept
+	conflictPolicy, err := rc.GetString("conflicts", "policy")
+	if err != nil {
+		conflictPolicy = CONFLICT_KEEP_BOTH
+	}
+	var conflictRules []string
+	if ruleList, err := rc.GetString("conflicts", "rules"); err == nil {
+		conflictRules = strings.Split(ruleList, ",")
+	}
+	var mergePatterns []string
+	if patternList, err := rc.GetString("conflicts", "merge"); err == nil {
+		mergePatterns = strings.Split(patternList, ",")
+	}
+	globals.conflicts, err = NewConflictPolicies(conflictPolicy, conflictRules, mergePatterns)
+	if err != nil {
+		return nil, err
+	}
+	globals.copyName, err = rc.GetString("conflicts", "copyname")
+	if err != nil {
+		globals.copyName = DEFAULT_CONFLICT_COPY_NAME
+	}
+	err = validConflictCopyName(globals.copyName)
+	if err != nil {
+		return nil, err
+	}
+
+	//the global ignore list is optional
+	var ignorePatterns []string
+	if ignoreList, err := rc.GetString("local", "ignore"); err == nil {
+		ignorePatterns = strings.Split(ignoreList, ",")
+	}
+	//conflicted copies are synchronized unless told otherwise
+	if syncCopies, err := rc.GetBool("conflicts", "synccopies"); err == nil && !syncCopies {
+		ignorePatterns = append(ignorePatterns, conflictCopyPattern(globals.copyName))
+	}
+	globals.ignore = NewIgnoreRules(globals.syncDir, globals.selection, ignorePatterns)
+
+	//default to inotify, falling back to polling only where it fails
+	globals.watcher, err = rc.GetString("local", "watcher")
+	if err != nil {
+		globals.watcher = "inotify"
+	} else if globals.watcher != "inotify" && globals.watcher != "poll" {
+		return nil, errors.New("Error: [local] watcher must be either 'inotify' or 'poll'")
+	}
+	globals.pollInterval = DEFAULT_POLL_INTERVAL
+	if seconds, err := rc.GetInt("local", "pollinterval"); err == nil && seconds > 0 {
+		globals.pollInterval = time.Duration(seconds) * time.Second
+	}
+	globals.symlinks, err = rc.GetString("local", "symlinks")
+	if err != nil {
+		globals.symlinks = SYMLINKS_SYNC
+	} else if globals.symlinks != SYMLINKS_SYNC && globals.symlinks != SYMLINKS_FOLLOW && globals.symlinks != SYMLINKS_IGNORE {
+		return nil, errors.New("Error: [local] symlinks must be one of '" + SYMLINKS_SYNC + "', '" + SYMLINKS_FOLLOW + "', or '" + SYMLINKS_IGNORE + "'")
+	}
+	globals.xattrs, err = rc.GetBool("local", "xattrs")
+	if err != nil {
+		globals.xattrs = true
+	}
+	globals.settleTime = DEFAULT_SETTLE_TIME
+	if ms, err := rc.GetInt("local", "settletime"); err == nil && ms >= 0 {
+		globals.settleTime = time.Duration(ms) * time.Millisecond
+	}
+	globals.maxSettleDelay = DEFAULT_MAX_SETTLE_DELAY
+	if ms, err := rc.GetInt("local", "maxsettledelay"); err == nil && ms >= 0 {
+		globals.maxSettleDelay = time.Duration(ms) * time.Millisecond
+	}
+
+	//make sure all the necessary directories exist
+	err = util.EnsureDirExists(globals.syncDir)
+	if err != nil {
+		return nil, err
+	}
+	err = util.EnsureDirExists(globals.cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	err = util.EnsureDirExists(globals.tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	//TODO check errors on server settings
+	globals.server, err = rc.GetString("server", "host")
+	globals.port, err = rc.GetInt("server", "port")
+	globals.username, err = rc.GetString("server", "username")
+	globals.password, err = rc.GetString("server", "password")
+	if pageSize, err := rc.GetInt("server", "pagesize"); err == nil && pageSize > 0 {
+		globals.pageSize = pageSize
+	}
+	globals.deviceName, err = rc.GetString("local", "devicename")
+	if err != nil || strings.TrimSpace(globals.deviceName) == "" {
+		globals.deviceName, err = os.Hostname()
+		if err != nil {
+			globals.deviceName = "unknown"
+		}
+	}
+	globals.share, err = rc.GetString("server", "share")
+	if err != nil {
+		globals.share = asink.DEFAULT_SHARE
+	} else if !asink.ValidShareName(globals.share) {
+		return nil, errors.New("Error: [server] share may only contain letters, numbers, '_', '.', and '-'")
+	}
+
+	//TODO check errors on encryption settings
+	globals.encrypted, err = rc.GetBool("encryption", "enabled")
+	if globals.encrypted {
+		globals.key, err = rc.GetString("encryption", "key")
+	}
+
+	globals.db, err = GetAndInitDB(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	//once this device is registered, it keeps the name it was registered with
+	registeredName, err := globals.db.DatabaseGetState(DEVICE_NAME_STATE)
+	if err != nil {
+		return nil, err
+	}
+	if registeredName != "" {
+		globals.deviceName = registeredName
+	}
+
+	latestClock, err := globals.db.DatabaseLatestClock()
+	if err != nil {
+		return nil, err
+	}
+	globals.clock = NewHybridClock(latestClock)
+
+	return globals, nil
+}
+
+//Synchronizes one sync root until the client exits or an error occurs
+func RunRoot(globals *AsinkGlobals) error {
+	//spawn goroutine to handle locking file paths
+	go globals.locker.Run(globals.db)
+
+	//spawn goroutines to handle local events
+	go SendEvents(globals)
+	localFileUpdates := make(chan *asink.Event)
+	globals.localUpdates = localFileUpdates
+	initialWalkComplete := make(chan int)
+	go StartWatching(globals, localFileUpdates, initialWalkComplete)
+
+	//spawn goroutines to receive remote events
+	remoteFileUpdates := make(chan *asink.Event)
+	snapshotApplied := make(chan int)
+	fatalErrors := make(chan error, 1)
+	go GetEvents(globals, remoteFileUpdates, snapshotApplied, fatalErrors)
+
+	//make chan with which to wait for exit
+	exitChan := make(chan int, 1)
+	asink.WaitOnExitChan(exitChan)
+
+	//stop this root (but not the others) if we can't get events from the
+	//server, returning the reason instead of the usual EXITED error
+	stopped := make(chan error, 1)
+	go func() {
+		err := <-fatalErrors
+		stopped <- err
+		select {
+		case exitChan <- 0:
+		default:
+		}
+	}()
+	stoppedErr := func(err error) error {
+		select {
+		case fatal := <-stopped:
+			return fatal
+		default:
+			return err
+		}
+	}
+
+	//create all the contexts
+	startupContext := NewStartupContext(globals, localFileUpdates, remoteFileUpdates, initialWalkComplete, snapshotApplied, exitChan)
+	normalContext := NewNormalContext(globals, localFileUpdates, remoteFileUpdates, exitChan)
+
+	//begin running contexts
+	err := startupContext.Run()
+	if err != nil && ErrorRequiresExit(err) {
+		return stoppedErr(err)
+	}
+
+	return stoppedErr(normalContext.Run())
+}
@@ -5,13 +5,18 @@
 package main
 
 import (
+	"errors"
 	"github.com/aclindsa/asink"
 	"net"
 	"net/http"
 	"net/rpc"
+	"path/filepath"
+	"strings"
 )
 
-type ClientAdmin int
+type ClientAdmin struct {
+	roots []*AsinkGlobals
+}
 
 func (c *ClientAdmin) StopClient(code *int, result *int) error {
 	asink.Exit(*code)
@@ -20,14 +25,73 @@ func (c *ClientAdmin) StopClient(code *int, result *int) error {
 }
 
 func (c *ClientAdmin) GetClientStatus(code *int, result *string) error {
-	*result = GetStats()
+	*result = GetStats(c.roots)
+	return nil
+}
+
+//Returns the history of the file or directory at the absolute path
+func (c *ClientAdmin) GetHistory(absolutePath *string, result *string) error {
+	for _, root := range c.roots {
+		if !strings.HasPrefix(*absolutePath+"/", root.syncDir+"/") {
+			continue
+		}
+		relativePath, err := filepath.Rel(root.syncDir, *absolutePath)
+		if err != nil {
+			return err
+		}
+		events, err := root.db.DatabaseGetHistory(relativePath)
+		if err != nil {
+			return err
+		}
+		*result = FormatHistory(root, events)
+		return nil
+	}
+	return errors.New(*absolutePath + " isn't inside any of the synchronized directories")
+}
+
+//Lists the unresolved conflicts in every sync root
+func (c *ClientAdmin) GetConflicts(code *int, result *string) error {
+	*result = ""
+	for _, root := range c.roots {
+		conflicts, err := root.db.DatabaseGetUnresolvedConflicts()
+		if err != nil {
+			return err
+		}
+		*result += FormatConflicts(root, conflicts)
+	}
+	if *result == "" {
+		*result = "No unresolved conflicts\n"
+	}
 	return nil
 }
 
-func StartRPC(sock string, tornDown chan int) {
+type ResolveConflictArgs struct {
+	AbsolutePath string
+	Resolution   string //one of RESOLVE_LOCAL, RESOLVE_REMOTE, RESOLVE_BOTH, or RESOLVE_MERGED
+	MergedFile   string //absolute path of the merged file, for RESOLVE_MERGED
+}
+
+//Resolves the latest unresolved conflict for the file at the absolute path
+func (c *ClientAdmin) ResolveConflict(args *ResolveConflictArgs, result *int) error {
+	for _, root := range c.roots {
+		if !strings.HasPrefix(args.AbsolutePath+"/", root.syncDir+"/") {
+			continue
+		}
+		relativePath, err := filepath.Rel(root.syncDir, args.AbsolutePath)
+		if err != nil {
+			return err
+		}
+		*result = 0
+		return resolveConflict(root, relativePath, args.Resolution, args.MergedFile)
+	}
+	return errors.New(args.AbsolutePath + " isn't inside any of the synchronized directories")
+}
+
+func StartRPC(sock string, tornDown chan int, roots []*AsinkGlobals) {
 	defer func() { tornDown <- 0 }() //the main thread waits for this to ensure the socket is closed
 
 	clientadmin := new(ClientAdmin)
+	clientadmin.roots = roots
 	rpc.Register(clientadmin)
 
 	rpc.HandleHTTP()
@@ -0,0 +1,260 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+//The subtrees of the sync directory this client keeps copies of. Events for
+//paths outside them are still tracked in the database (with their
+//LocalStatus marked SKIPPED), so that they can be downloaded if they are
+//selected later.
+type Selection struct {
+	include []string //if empty, everything not excluded is selected
+	exclude []string
+}
+
+func NewSelection(include, exclude []string) *Selection {
+	s := new(Selection)
+	s.include = cleanPrefixes(include)
+	s.exclude = cleanPrefixes(exclude)
+	return s
+}
+
+func cleanPrefixes(prefixes []string) (cleaned []string) {
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+		if prefix != "" {
+			cleaned = append(cleaned, path.Clean(prefix))
+		}
+	}
+	return cleaned
+}
+
+func isInside(relPath, prefix string) bool {
+	return relPath == prefix || strings.HasPrefix(relPath, prefix+"/")
+}
+
+//Returns true if relPath (relative to the sync directory) is inside the
+//selected subtrees. The directories containing an included subtree are
+//selected too, so that it has somewhere to live.
+func (s *Selection) Selected(relPath string) bool {
+	for _, prefix := range s.exclude {
+		if isInside(relPath, prefix) {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, prefix := range s.include {
+		if isInside(relPath, prefix) || strings.HasPrefix(prefix, relPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//Brings the sync directory in line with the selected subtrees, in case they
+//changed since the client last ran: tracked files which are newly selected
+//are downloaded, and the local copies of those no longer selected are
+//removed.
+func ApplySelection(globals *AsinkGlobals) error {
+	var tracked []*asink.Event
+	resultChan := make(chan *asink.Event)
+	errorChan := make(chan error)
+	go globals.db.DatabaseGetAllFiles(resultChan, errorChan)
+	for done := false; !done; {
+		select {
+		case event := <-resultChan:
+			if event == nil {
+				done = true
+			} else if (event.LocalStatus&asink.SKIPPED == 0) != globals.selection.Selected(event.Path) {
+				tracked = append(tracked, event)
+			}
+		case err := <-errorChan:
+			return err
+		}
+	}
+
+	//create directories before their contents, and remove them after
+	sort.Sort(eventsByPath(tracked))
+	for _, event := range tracked {
+		if globals.selection.Selected(event.Path) {
+			err := applySelection(globals, event.Path, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(tracked) - 1; i >= 0; i-- {
+		if !globals.selection.Selected(tracked[i].Path) {
+			err := applySelection(globals, tracked[i].Path, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type eventsByPath []*asink.Event
+
+func (e eventsByPath) Len() int           { return len(e) }
+func (e eventsByPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventsByPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+
+//(de)materializes the latest event for relPath while holding its lock
+func applySelection(globals *AsinkGlobals, relPath string, selected bool) (err error) {
+	latest := globals.locker.LockPath(relPath, false)
+	if latest == nil || !latest.IsUpdate() || (latest.LocalStatus&asink.SKIPPED == 0) == selected {
+		//it changed before we got to it, so there's nothing left to do
+		unchanged := new(asink.Event)
+		unchanged.Path = relPath
+		unchanged.LocalStatus = asink.DISCARDED
+		globals.locker.UnlockPath(unchanged)
+		return nil
+	}
+	defer globals.locker.UnlockPath(latest)
+
+	if selected {
+		err = materialize(globals, latest)
+		if err == nil {
+			latest.LocalStatus &^= asink.SKIPPED
+		}
+		return err
+	}
+	latest.LocalStatus |= asink.SKIPPED
+	return dematerialize(globals, latest)
+}
+
+//Creates the local copy of a tracked file or directory which wasn't
+//previously selected
+func materialize(globals *AsinkGlobals, event *asink.Event) error {
+	absolutePath := path.Join(globals.syncDir, event.Path)
+	if event.IsDirectory() {
+		return processRemoteDirectoryEvent(globals, event, absolutePath)
+	}
+
+	//don't clobber anything created locally while this path wasn't selected
+	if fileinfo, err := os.Lstat(absolutePath); err == nil && fileinfo.Mode().IsRegular() {
+		_, err = handleConflict(globals, event, absolutePath)
+		if err != nil {
+			return ProcessingError{PERMANENT, err}
+		}
+	}
+
+	if event.IsSymlink() {
+		return processRemoteSymlinkEvent(globals, event, absolutePath)
+	}
+
+	err := downloadEvent(globals, event, absolutePath)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(absolutePath, event.Permissions)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+	err = setEventMetadata(globals, event, absolutePath)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+	err = updateHashCache(globals, event, absolutePath)
+	if err != nil {
+		return ProcessingError{TEMPORARY, err}
+	}
+	return nil
+}
+
+//Materializes the tracked children of dir which are selected but haven't
+//been downloaded (i.e. because they were moved there from a subtree which
+//wasn't selected).
+func materializeChildren(globals *AsinkGlobals, dir string) error {
+	children, err := globals.db.DatabaseGetTrackedChildren(dir)
+	if err != nil {
+		return err
+	}
+	sort.Sort(eventsByPath(children))
+	for _, child := range children {
+		if child.LocalStatus&asink.SKIPPED == 0 || !globals.selection.Selected(child.Path) {
+			continue
+		}
+		err = materialize(globals, child)
+		if err != nil {
+			return err
+		}
+		child.LocalStatus &^= asink.SKIPPED
+		err = globals.db.DatabaseUpdateEvent(child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Removes the local copy of a tracked file or directory which is no longer
+//selected. Files with changes which haven't been synchronized, and
+//directories which aren't empty, are left alone.
+func dematerialize(globals *AsinkGlobals, event *asink.Event) error {
+	absolutePath := path.Join(globals.syncDir, event.Path)
+	fileinfo, err := os.Lstat(absolutePath)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case event.IsDirectory():
+		os.Remove(absolutePath)
+		return nil
+	case event.IsSymlink():
+		if fileinfo.Mode()&os.ModeSymlink != 0 {
+			os.Remove(absolutePath)
+		}
+		return nil
+	}
+
+	fileStat := NewHashCacheEntry(event.Path, fileinfo)
+	cached, err := globals.db.DatabaseGetHashCacheEntry(event.Path)
+	if err != nil {
+		return ProcessingError{TEMPORARY, err}
+	}
+	if fileStat == nil || cached == nil || !cached.Matches(fileStat) || cached.Hash != event.Hash {
+		return nil
+	}
+	err = os.Remove(absolutePath)
+	if err != nil {
+		return ProcessingError{PERMANENT, err}
+	}
+	err = globals.db.DatabaseRemoveHashCacheEntry(event.Path)
+	if err != nil {
+		return ProcessingError{TEMPORARY, err}
+	}
+	return nil
+}
+
+//Removes the local copies of a tracked directory and everything inside it,
+//deepest first
+func dematerializeTree(globals *AsinkGlobals, dir *asink.Event) error {
+	children, err := globals.db.DatabaseGetTrackedChildren(dir.Path)
+	if err != nil {
+		return ProcessingError{TEMPORARY, err}
+	}
+	sort.Sort(eventsByPath(children))
+	for i := len(children) - 1; i >= 0; i-- {
+		if children[i].LocalStatus&asink.SKIPPED == 0 {
+			err = dematerialize(globals, children[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return dematerialize(globals, dir)
+}
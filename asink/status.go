@@ -6,78 +6,107 @@ package main
 
 import (
 	"fmt"
+	"github.com/aclindsa/asink"
 	"sync/atomic"
 	"time"
 )
 
-var localUpdates int32 = 0
-var remoteUpdates int32 = 0
-var fileUploads int32 = 0
-var fileDownloads int32 = 0
-var sendingUpdates int32 = 0
-var onofflineSince int64 = 0 //low bit is 1 if online, 0 if offline
+//counters describing what one sync root is currently doing
+type Stats struct {
+	localUpdates   int32
+	remoteUpdates  int32
+	fileUploads    int32
+	fileDownloads  int32
+	sendingUpdates int32
+	onofflineSince int64  //low bit is 1 if online, 0 if offline
+	role           uint32 //our asink.ShareRole in the share, 0 until the server tells us
+	refusedUpdates int32  //local changes not sent because we have read-only access
+}
+
+func GetStats(roots []*AsinkGlobals) string {
+	status := "Asink client statistics:"
+	for _, root := range roots {
+		status += "\n" + root.stats.String(root)
+	}
+	return status
+}
 
-func GetStats() string {
-	local := atomic.LoadInt32(&localUpdates)
-	remote := atomic.LoadInt32(&remoteUpdates)
-	uploads := atomic.LoadInt32(&fileUploads)
-	downloads := atomic.LoadInt32(&fileDownloads)
-	onoffline := atomic.LoadInt64(&onofflineSince)
+func (s *Stats) String(root *AsinkGlobals) string {
+	local := atomic.LoadInt32(&s.localUpdates)
+	remote := atomic.LoadInt32(&s.remoteUpdates)
+	uploads := atomic.LoadInt32(&s.fileUploads)
+	downloads := atomic.LoadInt32(&s.fileDownloads)
+	sending := atomic.LoadInt32(&s.sendingUpdates)
+	onoffline := atomic.LoadInt64(&s.onofflineSince)
 	onoff := "On"
 	if onoffline&1 == 0 {
 		onoff = "Off"
 	}
 	onoffSinceTime := time.Unix(0, onoffline)
 
-	return fmt.Sprintf(`Asink client statistics:
+	status := fmt.Sprintf(`  %s (%s):
 	Processing %d file updates (%d local, %d remote)
 	Uploading %d files
 	Downloading %d files
 	Sending %d updates
-	%sline since %s`, local+remote, local, remote, uploads, downloads, sendingUpdates, onoff, onoffSinceTime.Format(time.RFC1123))
+	%sline since %s`, root.name, root.syncDir, local+remote, local, remote, uploads, downloads, sending, onoff, onoffSinceTime.Format(time.RFC1123))
+	if s.ReadOnly() {
+		status += fmt.Sprintf("\n\tRead-only access to share '%s' (%d local changes not sent)", root.share, atomic.LoadInt32(&s.refusedUpdates))
+	}
+	return status
 }
 
-func StatStartLocalUpdate() {
-	atomic.AddInt32(&localUpdates, 1)
+func (s *Stats) StartLocalUpdate() {
+	atomic.AddInt32(&s.localUpdates, 1)
+}
+func (s *Stats) StopLocalUpdate() {
+	atomic.AddInt32(&s.localUpdates, -1)
+}
+func (s *Stats) StartRemoteUpdate() {
+	atomic.AddInt32(&s.remoteUpdates, 1)
+}
+func (s *Stats) StopRemoteUpdate() {
+	atomic.AddInt32(&s.remoteUpdates, -1)
 }
-func StatStopLocalUpdate() {
-	atomic.AddInt32(&localUpdates, -1)
+func (s *Stats) StartUpload() {
+	atomic.AddInt32(&s.fileUploads, 1)
 }
-func StatStartRemoteUpdate() {
-	atomic.AddInt32(&remoteUpdates, 1)
+func (s *Stats) StopUpload() {
+	atomic.AddInt32(&s.fileUploads, -1)
 }
-func StatStopRemoteUpdate() {
-	atomic.AddInt32(&remoteUpdates, -1)
+func (s *Stats) StartDownload() {
+	atomic.AddInt32(&s.fileDownloads, 1)
 }
-func StatStartUpload() {
-	atomic.AddInt32(&fileUploads, 1)
+func (s *Stats) StopDownload() {
+	atomic.AddInt32(&s.fileDownloads, -1)
 }
-func StatStopUpload() {
-	atomic.AddInt32(&fileUploads, -1)
+func (s *Stats) StartSending() {
+	atomic.AddInt32(&s.sendingUpdates, 1)
 }
-func StatStartDownload() {
-	atomic.AddInt32(&fileDownloads, 1)
+func (s *Stats) StopSending() {
+	atomic.AddInt32(&s.sendingUpdates, -1)
 }
-func StatStopDownload() {
-	atomic.AddInt32(&fileDownloads, -1)
+func (s *Stats) SetRole(role asink.ShareRole) {
+	atomic.StoreUint32(&s.role, uint32(role))
 }
-func StatStartSending() {
-	atomic.AddInt32(&sendingUpdates, 1)
+func (s *Stats) ReadOnly() bool {
+	role := asink.ShareRole(atomic.LoadUint32(&s.role))
+	return role != 0 && !role.CanWrite()
 }
-func StatStopSending() {
-	atomic.AddInt32(&sendingUpdates, -1)
+func (s *Stats) RefusedUpdate() {
+	atomic.AddInt32(&s.refusedUpdates, 1)
 }
-func StatOnline() {
-	unixNano := atomic.LoadInt64(&onofflineSince)
+func (s *Stats) Online() {
+	unixNano := atomic.LoadInt64(&s.onofflineSince)
 	if unixNano == 0 || unixNano&1 == 0 {
 		unixNano := time.Now().UnixNano() | 1
-		atomic.StoreInt64(&onofflineSince, unixNano)
+		atomic.StoreInt64(&s.onofflineSince, unixNano)
 	}
 }
-func StatOffline() {
-	unixNano := atomic.LoadInt64(&onofflineSince)
+func (s *Stats) Offline() {
+	unixNano := atomic.LoadInt64(&s.onofflineSince)
 	if unixNano == 0 || unixNano&1 != 0 {
 		unixNano = time.Now().UnixNano() & ^1
-		atomic.StoreInt64(&onofflineSince, unixNano)
+		atomic.StoreInt64(&s.onofflineSince, unixNano)
 	}
 }
@@ -5,7 +5,6 @@
 package main
 
 import (
-	"code.google.com/p/goconf/conf"
 	"errors"
 	"io"
 )
@@ -19,7 +18,7 @@ type Storage interface {
 	Get(hash string) (io.ReadCloser, error)
 }
 
-func GetStorage(config *conf.ConfigFile) (Storage, error) {
+func GetStorage(config *RootConfig) (Storage, error) {
 	storageMethod, err := config.GetString("storage", "method")
 	if err != nil {
 		return nil, errors.New("Error: storage method not specified in config file.")
@@ -5,7 +5,6 @@
 package main
 
 import (
-	"code.google.com/p/goconf/conf"
 	"errors"
 	"github.com/jlaffaye/ftp"
 	"io"
@@ -23,7 +22,7 @@ type FTPStorage struct {
 	password        string
 }
 
-func NewFTPStorage(config *conf.ConfigFile) (*FTPStorage, error) {
+func NewFTPStorage(config *RootConfig) (*FTPStorage, error) {
 	server, err := config.GetString("storage", "server")
 	if err != nil {
 		return nil, errors.New("Error: FTPStorage indicated in config file, but 'server' not specified.")
@@ -6,7 +6,6 @@ package main
 
 import (
 	"code.google.com/p/goauth2/oauth"
-	"code.google.com/p/goconf/conf"
 	"code.google.com/p/google-api-go-client/drive/v2"
 	"errors"
 	"fmt"
@@ -26,7 +25,7 @@ type GDriveStorage struct {
 	service   *drive.Service
 }
 
-func NewGDriveStorage(config *conf.ConfigFile) (*GDriveStorage, error) {
+func NewGDriveStorage(config *RootConfig) (*GDriveStorage, error) {
 	cachefile, err := config.GetString("storage", "cachefile")
 	if err != nil {
 		return nil, errors.New("Error: GDriveStorage indicated in config file, but 'cachefile' not specified.")
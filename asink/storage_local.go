@@ -5,7 +5,6 @@
 package main
 
 import (
-	"code.google.com/p/goconf/conf"
 	"errors"
 	"github.com/aclindsa/asink/util"
 	"io"
@@ -19,7 +18,7 @@ type LocalStorage struct {
 	tmpSubdir  string
 }
 
-func NewLocalStorage(config *conf.ConfigFile) (*LocalStorage, error) {
+func NewLocalStorage(config *RootConfig) (*LocalStorage, error) {
 	storageDir, err := config.GetString("storage", "dir")
 	if err != nil {
 		return nil, errors.New("Error: LocalStorage indicated in config file, but lacking local storage directory ('dir = some/dir').")
@@ -0,0 +1,132 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//How symbolic links under the sync directory are handled
+const (
+	SYMLINKS_SYNC   = "sync-as-link" //synchronize the links themselves
+	SYMLINKS_FOLLOW = "follow"       //synchronize whatever the links point to, as if it were in their place
+	SYMLINKS_IGNORE = "ignore"       //pretend links don't exist
+)
+
+var LinkOutsideSyncDirErr = errors.New("Error: Symbolic link points outside the sync directory")
+
+//Like filepath.Walk, but handles symbolic links according to the configured
+//policy. When following links, directories which are their own ancestors
+//are skipped to avoid walking in circles.
+func WalkTree(globals *AsinkGlobals, root string, walkFn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return walkTree(globals, root, info, walkFn, make(map[[2]uint64]bool))
+}
+
+func walkTree(globals *AsinkGlobals, path string, info os.FileInfo, walkFn filepath.WalkFunc, ancestors map[[2]uint64]bool) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch globals.symlinks {
+		case SYMLINKS_IGNORE:
+			return nil
+		case SYMLINKS_FOLLOW:
+			target, err := os.Stat(path)
+			if err != nil {
+				//dangling links have nothing to follow
+				return nil
+			}
+			info = target
+		}
+	}
+
+	var id [2]uint64
+	if info.IsDir() {
+		if fileStat := NewHashCacheEntry("", info); fileStat != nil {
+			id = [2]uint64{fileStat.Device, fileStat.Inode}
+			if ancestors[id] {
+				fmt.Println("Not following symbolic link " + path + " because it would cause a loop")
+				return nil
+			}
+		}
+	}
+
+	err := walkFn(path, info, nil)
+	if err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	if id != [2]uint64{} {
+		ancestors[id] = true
+		defer delete(ancestors, id)
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return walkFn(path, info, err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return walkFn(path, info, err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileInfo, err := os.Lstat(filename)
+		if err != nil {
+			err = walkFn(filename, fileInfo, err)
+		} else {
+			err = walkTree(globals, filename, fileInfo, walkFn, ancestors)
+		}
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+//Like os.Lstat, but follows path if it is a symbolic link and links are
+//configured to be followed
+func statPath(globals *AsinkGlobals, path string) (os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 && globals.symlinks == SYMLINKS_FOLLOW {
+		return os.Stat(path)
+	}
+	return info, err
+}
+
+//Returns target, the destination of the symbolic link at absolutePath,
+//relative to the link's directory. Absolute targets inside the sync
+//directory are rewritten to be relative so they remain valid on other
+//computers, and targets outside it return LinkOutsideSyncDirErr.
+func relativeLinkTarget(globals *AsinkGlobals, absolutePath, target string) (string, error) {
+	linkDir := filepath.Dir(absolutePath)
+	absTarget := target
+	if !filepath.IsAbs(target) {
+		absTarget = filepath.Join(linkDir, target)
+	}
+	absTarget = filepath.Clean(absTarget)
+	if absTarget != globals.syncDir && !strings.HasPrefix(absTarget, globals.syncDir+"/") {
+		return "", LinkOutsideSyncDirErr
+	}
+	if !filepath.IsAbs(target) {
+		return target, nil
+	}
+	return filepath.Rel(linkDir, absTarget)
+}
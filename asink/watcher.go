@@ -5,70 +5,283 @@
 package main
 
 import (
+	"fmt"
 	"github.com/aclindsa/asink"
 	"github.com/howeyc/fsnotify"
 	"os"
+	"path"
 	"path/filepath"
-	"time"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-func StartWatching(watchDir string, fileUpdates chan *asink.Event, initialWalkComplete chan int) {
+//how long to wait for the other half of a move before deciding a file or
+//directory was actually deleted
+const MOVE_PAIRING_WINDOW = 500 * time.Millisecond
+
+func StartWatching(globals *AsinkGlobals, fileUpdates chan *asink.Event, initialWalkComplete chan int) {
+	watchDir := globals.syncDir
+	ignore := globals.ignore
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		panic("Failed to create fsnotify watcher")
+		fmt.Println("Failed to create fsnotify watcher, polling for changes instead")
+		globals.watcher = "poll"
+	}
+
+	//Subtrees which can't be watched with inotify (or everything, if
+	//configured to poll) are instead periodically scanned for changes
+	poller := NewPoller(globals, fileUpdates)
+	if globals.watcher == "poll" {
+		poller.AddRoot(watchDir)
+	}
+
+	settler := NewSettler(globals.settleTime, globals.maxSettleDelay, fileUpdates)
+	globals.settler = settler
+
+	var warnOnce sync.Once
+	watch := func(path string) {
+		if watcher == nil || poller.Covers(path) {
+			return
+		}
+		err := watcher.Watch(path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if e, ok := err.(syscall.Errno); ok && e == syscall.ENOSPC {
+			//If we reach here, it means we've received ENOSPC from the Linux kernel:
+			//ENOSPC The user limit on the total number of inotify watches was reached or the kernel failed to allocate a needed resource.
+			warnOnce.Do(func() {
+				fmt.Println("Exhausted the allowed number of inotify watches, falling back to polling for changes in directories which can't be watched. Consider increasing /proc/sys/fs/inotify/max_user_watches")
+			})
+		} else {
+			fmt.Println("Failed to watch " + path + " (" + err.Error() + "), polling for changes instead")
+		}
+		poller.AddRoot(path)
 	}
 
 	//function called by filepath.Walk to start watching a directory and all subdirectories
 	watchDirFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != watchDir && ignore.Ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if info.IsDir() {
-			err = watcher.Watch(path)
+			//load this directory's ignore rules before visiting its contents
+			err = ignore.LoadDir(path)
 			if err != nil {
-				if e, ok := err.(syscall.Errno); ok && e == 28 {
-					//If we reach here, it means we've received ENOSPC from the Linux kernel:
-					//ENOSPC The user limit on the total number of inotify watches was reached or the kernel failed to allocate a needed resource.
-					panic("Exhausted the allowed number of inotify watches, please increase /proc/sys/fs/inotify/max_user_watches")
-				}
-				panic("Failed to watch " + path)
+				fmt.Println(err)
 			}
-		} else if info.Mode().IsRegular() {
+			watch(path)
+			if path != watchDir {
+				event := new(asink.Event)
+				event.Path = path
+				event.Type = asink.UPDATE | asink.DIRECTORY
+				event.Timestamp = time.Now().UnixNano()
+				event.Clock = globals.clock.Now()
+				fileUpdates <- event
+			}
+		} else if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
 			event := new(asink.Event)
 			event.Path = path
 			event.Type = asink.UPDATE
 			event.Timestamp = time.Now().UnixNano()
+			event.Clock = globals.clock.Now()
 			fileUpdates <- event
 		}
 		return nil
 	}
 
+	//function called by filepath.Walk to watch the contents of a directory
+	//which was moved, without generating events for them
+	rewatchDirFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if ignore.Ignored(path, true) {
+			return filepath.SkipDir
+		}
+		err = ignore.LoadDir(path)
+		if err != nil {
+			fmt.Println(err)
+		}
+		watch(path)
+		return nil
+	}
+
+	//Moves show up as a rename of the source followed by the creation of
+	//the destination. Because fsnotify doesn't expose inotify's cookies,
+	//they are paired by looking up the destination's inode in the hash
+	//cache. Until that happens (or MOVE_PAIRING_WINDOW elapses and we give
+	//up and report a deletion), sources are kept in pendingMoves.
+	var pendingLock sync.Mutex
+	pendingMoves := make(map[string]*time.Timer)
+	recentlyMoved := make(map[string]bool) //sources paired recently, whose duplicate renames (i.e. IN_MOVE_SELF) should be ignored
+
+	movedFrom := func(name string) {
+		pendingLock.Lock()
+		defer pendingLock.Unlock()
+		if _, ok := pendingMoves[name]; ok || recentlyMoved[name] {
+			return
+		}
+
+		var timer *time.Timer
+		timer = time.AfterFunc(MOVE_PAIRING_WINDOW, func() {
+			pendingLock.Lock()
+			if pendingMoves[name] != timer {
+				pendingLock.Unlock()
+				return
+			}
+			delete(pendingMoves, name)
+			pendingLock.Unlock()
+
+			event := new(asink.Event)
+			event.Path = name
+			event.Type = asink.DELETE
+			event.Timestamp = time.Now().UnixNano()
+			event.Clock = globals.clock.Now()
+			settler.Pass(event)
+		})
+		pendingMoves[name] = timer
+	}
+
+	//returns a MOVE event if the newly-created 'name' is the destination of
+	//a pending move, nil otherwise
+	movedTo := func(name string, info os.FileInfo) *asink.Event {
+		fileStat := NewHashCacheEntry("", info)
+		if fileStat == nil {
+			return nil
+		}
+		cached, err := globals.db.DatabaseGetHashCacheEntryByInode(fileStat.Device, fileStat.Inode)
+		if err != nil || cached == nil {
+			return nil
+		}
+		source := filepath.Join(watchDir, cached.Path)
+		if source == name {
+			return nil
+		}
+
+		pendingLock.Lock()
+		defer pendingLock.Unlock()
+		timer, ok := pendingMoves[source]
+		if !ok || !timer.Stop() {
+			return nil
+		}
+		delete(pendingMoves, source)
+		recentlyMoved[source] = true
+		time.AfterFunc(MOVE_PAIRING_WINDOW, func() {
+			pendingLock.Lock()
+			delete(recentlyMoved, source)
+			pendingLock.Unlock()
+		})
+
+		event := new(asink.Event)
+		event.Path = name
+		event.SourcePath = source
+		event.Type = asink.UPDATE | asink.MOVE
+		if info.IsDir() {
+			event.Type |= asink.DIRECTORY
+		}
+		event.Timestamp = time.Now().UnixNano()
+		event.Clock = globals.clock.Now()
+		return event
+	}
+
+	//If inotify reports an error (i.e. its queue overflowed), events may
+	//have been lost, so walk the whole tree again to find anything we missed
+	var rescanning int32
+	rescan := func() {
+		if !atomic.CompareAndSwapInt32(&rescanning, 0, 1) {
+			return
+		}
+		go func() {
+			defer atomic.StoreInt32(&rescanning, 0)
+			WalkTree(globals, watchDir, watchDirFn)
+			deletedFiles, err := FindDeletedFiles(globals)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			for _, event := range deletedFiles {
+				fileUpdates <- event
+			}
+		}()
+	}
+
 	//processes all the fsnotify events into asink events
 	go func() {
-		for {
+		for watcher != nil {
 			select {
 			case ev := <-watcher.Event:
+				//if ignore rules changed, reload them and re-scan the
+				//directory they apply to in order to pick up any files
+				//which are no longer ignored
+				if filepath.Base(ev.Name) == IGNORE_FILENAME {
+					dir := filepath.Dir(ev.Name)
+					err := ignore.LoadDir(dir)
+					if err != nil {
+						fmt.Println(err)
+					}
+					if !ignore.Ignored(dir, true) {
+						WalkTree(globals, dir, watchDirFn)
+					}
+				}
+
 				//if a directory was created, begin recursively watching all its subdirectories
-				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
-					if ev.IsCreate() {
-						//Note: even though filepath.Walk will visit root, we must watch root first so we catch files/directories created after the walk begins but before this directory begins being watched
-						err = watcher.Watch(ev.Name)
-						if err != nil {
-							if e, ok := err.(syscall.Errno); ok && e == 28 {
-								//If we reach here, it means we've received ENOSPC from the Linux kernel:
-								//ENOSPC The user limit on the total number of inotify watches was reached or the kernel failed to allocate a needed resource.
-								panic("Exhausted the allowed number of inotify watches, please increase /proc/sys/fs/inotify/max_user_watches")
-							}
-							panic("Failed to watch " + ev.Name)
+				if fi, err := statPath(globals, ev.Name); err == nil && fi.IsDir() {
+					if ev.IsCreate() && !ignore.Ignored(ev.Name, true) {
+						if event := movedTo(ev.Name, fi); event != nil {
+							//the directory's contents came along with it, so
+							//only the watches need updating
+							WalkTree(globals, ev.Name, rewatchDirFn)
+							settler.Pass(event)
+							continue
 						}
+						//Note: even though filepath.Walk will visit root, we must watch root first so we catch files/directories created after the walk begins but before this directory begins being watched
+						watch(ev.Name)
 						//scan this directory to ensure any file events we missed before starting to watch this directory are caught
-						filepath.Walk(ev.Name, watchDirFn)
+						WalkTree(globals, ev.Name, watchDirFn)
+					} else if ev.IsModify() && ev.Name != watchDir && !ignore.Ignored(ev.Name, true) {
+						//pick up changes to the directory's permissions
+						event := new(asink.Event)
+						event.Path = ev.Name
+						event.Type = asink.UPDATE | asink.DIRECTORY
+						event.Timestamp = time.Now().UnixNano()
+						event.Clock = globals.clock.Now()
+						fileUpdates <- event
 					}
 					continue
 				}
 
+				if ignore.Ignored(ev.Name, false) {
+					continue
+				}
+
+				if ev.IsRename() {
+					movedFrom(ev.Name)
+					continue
+				}
+
+				if ev.IsCreate() {
+					if fi, err := os.Lstat(ev.Name); err == nil {
+						if event := movedTo(ev.Name, fi); event != nil {
+							settler.Pass(event)
+							continue
+						}
+					}
+				}
+
 				event := new(asink.Event)
 				if ev.IsCreate() || ev.IsModify() {
 					event.Type = asink.UPDATE
-				} else if ev.IsDelete() || ev.IsRename() {
+				} else if ev.IsDelete() {
 					event.Type = asink.DELETE
 				} else {
 					panic("Unknown fsnotify event type")
@@ -76,16 +289,72 @@ func StartWatching(watchDir string, fileUpdates chan *asink.Event, initialWalkCo
 
 				event.Path = ev.Name
 				event.Timestamp = time.Now().UnixNano()
+				event.Clock = globals.clock.Now()
 
-				fileUpdates <- event
+				//wait for files being written to settle down before
+				//reporting them
+				if event.IsUpdate() {
+					settler.Settle(event)
+				} else {
+					settler.Pass(event)
+				}
 
 			case err := <-watcher.Error:
-				panic(err)
+				fmt.Println("Error watching for changes, re-scanning " + watchDir + ": " + err.Error())
+				rescan()
 			}
 		}
 	}()
 
 	//start watching the directory passed in
-	filepath.Walk(watchDir, watchDirFn)
+	WalkTree(globals, watchDir, watchDirFn)
 	initialWalkComplete <- 0
+
+	poller.Run(globals.pollInterval)
+}
+
+//Returns DELETE events for all the files tracked in the database which no
+//longer exist (and aren't ignored)
+func FindDeletedFiles(globals *AsinkGlobals) ([]*asink.Event, error) {
+	deletedFiles := []*asink.Event{}
+	resultChan := make(chan *asink.Event)
+	errorChan := make(chan error)
+	go globals.db.DatabaseGetAllFiles(resultChan, errorChan)
+	for {
+		select {
+		case oldEvent := <-resultChan:
+			if oldEvent == nil {
+				return deletedFiles, nil
+			}
+
+			//if the file still exists, disregard this event
+			absolutePath := path.Join(globals.syncDir, oldEvent.Path)
+			if _, err := os.Lstat(absolutePath); err == nil {
+				break
+			}
+
+			//don't delete the remote copies of files which are now ignored
+			if globals.ignore.Ignored(oldEvent.Path, oldEvent.IsDirectory()) {
+				break
+			}
+
+			//links were never created locally if we're ignoring them, and
+			//neither were files outside the selected subtrees
+			if (oldEvent.IsSymlink() && globals.symlinks == SYMLINKS_IGNORE) || oldEvent.LocalStatus&asink.SKIPPED != 0 {
+				break
+			}
+
+			event := new(asink.Event)
+			event.Path = absolutePath
+			event.Type = asink.DELETE
+			if oldEvent.IsDirectory() {
+				event.Type |= asink.DIRECTORY
+			}
+			event.Timestamp = time.Now().UnixNano()
+			event.Clock = globals.clock.Now()
+			deletedFiles = append(deletedFiles, event)
+		case err := <-errorChan:
+			return nil, err
+		}
+	}
 }
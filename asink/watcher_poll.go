@@ -0,0 +1,247 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_POLL_INTERVAL = 30 * time.Second
+
+//what the poller knows about each file or directory it has seen
+type pollState struct {
+	isDir  bool
+	isLink bool
+	mode   os.FileMode
+	size   int64
+	mtime  time.Time
+	device uint64
+	inode  uint64
+}
+
+//Watches subtrees of the sync directory by periodically walking them and
+//comparing what it finds to the previous walk. This is used for filesystems
+//on which inotify doesn't work (i.e. network filesystems), and for subtrees
+//which can't be watched with inotify because we've run out of watches.
+type Poller struct {
+	lock        sync.Mutex
+	globals     *AsinkGlobals
+	fileUpdates chan *asink.Event
+	roots       []string
+	state       map[string]pollState
+}
+
+func NewPoller(globals *AsinkGlobals, fileUpdates chan *asink.Event) *Poller {
+	p := new(Poller)
+	p.globals = globals
+	p.fileUpdates = fileUpdates
+	p.state = make(map[string]pollState)
+	return p
+}
+
+//returns true if 'path' is inside a subtree being polled
+func (p *Poller) Covers(path string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.covers(path)
+}
+
+func (p *Poller) covers(path string) bool {
+	for _, root := range p.roots {
+		if path == root || strings.HasPrefix(path, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//Begin polling the subtree at 'root'. Its current contents are recorded
+//without generating events for them.
+func (p *Poller) AddRoot(root string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.covers(root) {
+		return
+	}
+
+	//this root may contain ones we were already polling
+	roots := []string{root}
+	for _, r := range p.roots {
+		if !strings.HasPrefix(r, root+"/") {
+			roots = append(roots, r)
+		}
+	}
+	p.roots = roots
+
+	for path, state := range p.walk(root) {
+		p.state[path] = state
+	}
+}
+
+//Poll all roots every 'interval', forever
+func (p *Poller) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		p.Scan()
+	}
+}
+
+//Walk each root, sending events for everything that changed since the
+//last time it was walked
+func (p *Poller) Scan() {
+	p.lock.Lock()
+	roots := append([]string{}, p.roots...)
+	p.lock.Unlock()
+
+	for _, root := range roots {
+		events := p.scanRoot(root)
+		for _, event := range events {
+			p.fileUpdates <- event
+		}
+	}
+}
+
+//returns what currently exists under root, loading any ignore rules found
+//along the way
+func (p *Poller) walk(root string) map[string]pollState {
+	found := make(map[string]pollState)
+	ignore := p.globals.ignore
+	WalkTree(p.globals, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != p.globals.syncDir && ignore.Ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		isLink := info.Mode()&os.ModeSymlink != 0
+		if info.IsDir() {
+			ignore.LoadDir(path)
+		} else if !info.Mode().IsRegular() && !isLink {
+			return nil
+		}
+
+		state := pollState{isDir: info.IsDir(), isLink: isLink, mode: info.Mode(), size: info.Size(), mtime: info.ModTime()}
+		if fileStat := NewHashCacheEntry("", info); fileStat != nil {
+			state.device = fileStat.Device
+			state.inode = fileStat.Inode
+		}
+		found[path] = state
+		return nil
+	})
+	return found
+}
+
+func (p *Poller) scanRoot(root string) (events []*asink.Event) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	found := p.walk(root)
+	now := time.Now().UnixNano()
+	newEvent := func(eventType asink.EventType, path string, isDir bool) *asink.Event {
+		event := new(asink.Event)
+		event.Type = eventType
+		if isDir {
+			event.Type |= asink.DIRECTORY
+		}
+		event.Path = path
+		event.Timestamp = now
+		event.Clock = p.globals.clock.Now()
+		return event
+	}
+
+	//find everything which disappeared, keyed by inode so they can be
+	//paired up with new paths to detect moves
+	missing := make(map[uint64]string)
+	var deleted []string
+	for path, state := range p.state {
+		if path != root && !strings.HasPrefix(path, root+"/") {
+			continue
+		}
+		if _, ok := found[path]; !ok {
+			deleted = append(deleted, path)
+			if state.inode != 0 && !state.isLink {
+				missing[state.inode] = path
+			}
+		}
+	}
+
+	//sort so directories are visited before their contents
+	var paths []string
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var movedDirs [][2]string //source and destination of moved directories
+	movedInto := func(path string) bool {
+		for _, m := range movedDirs {
+			if strings.HasPrefix(path, m[1]+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	movedFrom := func(path string) bool {
+		for _, m := range movedDirs {
+			if path == m[0] || strings.HasPrefix(path, m[0]+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, path := range paths {
+		state := found[path]
+		old, existed := p.state[path]
+		p.state[path] = state
+		if path == p.globals.syncDir || movedInto(path) {
+			continue
+		}
+
+		if !existed || old.inode != state.inode || old.isDir != state.isDir {
+			if source, ok := missing[state.inode]; ok && state.inode != 0 && p.state[source].device == state.device && p.state[source].isDir == state.isDir {
+				delete(missing, state.inode)
+				event := newEvent(asink.UPDATE|asink.MOVE, path, state.isDir)
+				event.SourcePath = source
+				events = append(events, event)
+				if state.isDir {
+					movedDirs = append(movedDirs, [2]string{source, path})
+				}
+				continue
+			}
+			events = append(events, newEvent(asink.UPDATE, path, state.isDir))
+		} else if old.mode != state.mode || (!state.isDir && (old.size != state.size || !old.mtime.Equal(state.mtime))) {
+			events = append(events, newEvent(asink.UPDATE, path, state.isDir))
+		}
+	}
+
+	for _, path := range deleted {
+		//paths which still exist have only become ignored, and shouldn't
+		//be deleted elsewhere
+		if _, err := os.Lstat(path); err != nil && !movedFrom(path) && !isMoveSource(events, path) {
+			events = append(events, newEvent(asink.DELETE, path, p.state[path].isDir))
+		}
+		delete(p.state, path)
+	}
+	return events
+}
+
+func isMoveSource(events []*asink.Event, path string) bool {
+	for _, event := range events {
+		if event.IsMove() && event.SourcePath == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SETTLE_TIME = 1 * time.Second
+const DEFAULT_MAX_SETTLE_DELAY = 60 * time.Second
+
+type settlingFile struct {
+	event *asink.Event
+	first time.Time //when the first event for this file was held
+	size  int64
+	mtime time.Time
+	timer *time.Timer
+}
+
+//Holds updates to files which are still being written, so they aren't
+//copied, hashed and uploaded in the middle of being written. An update is
+//only passed along once the file's size and modification time haven't
+//changed for settleTime, or it has been held for maxDelay.
+type Settler struct {
+	lock        sync.Mutex
+	settleTime  time.Duration
+	maxDelay    time.Duration
+	fileUpdates chan *asink.Event
+	pending     map[string]*settlingFile
+}
+
+func NewSettler(settleTime, maxDelay time.Duration, fileUpdates chan *asink.Event) *Settler {
+	s := new(Settler)
+	s.settleTime = settleTime
+	s.maxDelay = maxDelay
+	s.fileUpdates = fileUpdates
+	s.pending = make(map[string]*settlingFile)
+	return s
+}
+
+//Hold an update to a regular file until it settles. Any further updates
+//to the same file received in the meantime are coalesced into one.
+func (s *Settler) Settle(event *asink.Event) {
+	if s.settleTime <= 0 {
+		s.fileUpdates <- event
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f, ok := s.pending[event.Path]; ok {
+		f.event = event
+		return
+	}
+
+	f := new(settlingFile)
+	f.event = event
+	f.first = time.Now()
+	if info, err := os.Lstat(event.Path); err == nil {
+		f.size = info.Size()
+		f.mtime = info.ModTime()
+	}
+	f.timer = time.AfterFunc(s.settleTime, func() { s.check(event.Path) })
+	s.pending[event.Path] = f
+}
+
+//Hold an update to a file which couldn't be processed because it kept
+//changing, so it is tried again once it settles. Unlike Settle, this never
+//blocks, so it may be called while processing events.
+func (s *Settler) Requeue(event *asink.Event) {
+	if s.settleTime <= 0 {
+		time.AfterFunc(DEFAULT_SETTLE_TIME, func() { s.fileUpdates <- event })
+		return
+	}
+	s.Settle(event)
+}
+
+//Pass an event along immediately. Updates still being held for the same
+//path (or for the source of a move) are dropped, since they are superseded.
+func (s *Settler) Pass(event *asink.Event) {
+	s.lock.Lock()
+	s.drop(event.Path)
+	if event.IsMove() {
+		s.drop(event.SourcePath)
+	}
+	s.lock.Unlock()
+
+	s.fileUpdates <- event
+}
+
+//Pass an event along without waiting for it to be received, so it may be
+//called while processing events
+func (s *Settler) PassLater(event *asink.Event) {
+	go s.Pass(event)
+}
+
+func (s *Settler) drop(path string) {
+	if f, ok := s.pending[path]; ok {
+		f.timer.Stop()
+		delete(s.pending, path)
+	}
+}
+
+func (s *Settler) check(path string) {
+	s.lock.Lock()
+	f, ok := s.pending[path]
+	if !ok {
+		s.lock.Unlock()
+		return
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		//the deletion will generate its own event
+		delete(s.pending, path)
+		s.lock.Unlock()
+		return
+	}
+
+	if (info.Size() == f.size && info.ModTime().Equal(f.mtime)) || time.Since(f.first) >= s.maxDelay {
+		delete(s.pending, path)
+		s.lock.Unlock()
+		s.fileUpdates <- f.event
+		return
+	}
+
+	f.size = info.Size()
+	f.mtime = info.ModTime()
+	f.timer.Reset(s.settleTime)
+	s.lock.Unlock()
+}
@@ -0,0 +1,78 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/aclindsa/asink"
+	"os"
+	"time"
+)
+
+//only extended attributes in this namespace are synchronized (others are
+//either privileged, or specific to this computer)
+const XATTR_NAMESPACE = "user."
+
+//Encodes extended attributes as they are stored in events, which is "" if
+//there aren't any. Because the keys of the JSON object are sorted, equal
+//sets of attributes always encode to equal strings.
+func encodeXattrs(attrs map[string][]byte) (string, error) {
+	if len(attrs) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeXattrs(encoded string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	if encoded == "" {
+		return attrs, nil
+	}
+	err := json.Unmarshal([]byte(encoded), &attrs)
+	return attrs, err
+}
+
+//returns the encoded extended attributes of the file at absolutePath, or ""
+//if they aren't being synchronized
+func getEventXattrs(globals *AsinkGlobals, absolutePath string) (string, error) {
+	if !globals.xattrs {
+		return "", nil
+	}
+	attrs, err := getXattrs(absolutePath)
+	if err != nil {
+		return "", err
+	}
+	return encodeXattrs(attrs)
+}
+
+//Applies an event's modification time and extended attributes to the file
+//at absolutePath. Extended attributes the event doesn't have are removed.
+func setEventMetadata(globals *AsinkGlobals, event *asink.Event, absolutePath string) error {
+	if event.MTime != 0 && !event.IsDirectory() {
+		mtime := time.Unix(0, event.MTime)
+		err := os.Chtimes(absolutePath, mtime, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	if !globals.xattrs {
+		return nil
+	}
+	attrs, err := decodeXattrs(event.Xattrs)
+	if err != nil {
+		return err
+	}
+	return setXattrs(absolutePath, attrs)
+}
+
+//returns true if both events carry the same permissions, modification time
+//and extended attributes
+func sameMetadata(e1 *asink.Event, e2 *asink.Event) bool {
+	return e1.Permissions == e2.Permissions && e1.MTime == e2.MTime && e1.Xattrs == e2.Xattrs
+}
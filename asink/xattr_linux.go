@@ -0,0 +1,87 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+//returns the names of the synchronized extended attributes of a file
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if strings.HasPrefix(name, XATTR_NAMESPACE) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+//Returns the synchronized extended attributes of a file. Filesystems which
+//don't support extended attributes are treated as if files on them have
+//none.
+func getXattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrs(path)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range names {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:size]
+	}
+	return attrs, nil
+}
+
+//Makes the synchronized extended attributes of a file match attrs
+func setXattrs(path string, attrs map[string][]byte) error {
+	names, err := listXattrs(path)
+	if err == syscall.ENOTSUP {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, ok := attrs[name]; !ok {
+			err = syscall.Removexattr(path, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range attrs {
+		if !strings.HasPrefix(name, XATTR_NAMESPACE) {
+			continue
+		}
+		err = syscall.Setxattr(path, name, value, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+//extended attributes are only supported on Linux
+
+func getXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
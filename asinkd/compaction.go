@@ -0,0 +1,287 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aclindsa/asink"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Which events are kept when a share's events are compacted. The latest
+//version of each file which still exists is always kept, as is each share's
+//latest event (so its ids are never reused).
+type RetentionPolicy struct {
+	KeepVersions  int           //keep this many of the latest versions of each file, 0 to keep them all
+	KeepFor       time.Duration //also keep all versions newer than this, 0 to only use KeepVersions
+	TombstonesFor time.Duration //forget deleted files this long after they were deleted, 0 to never forget them
+}
+
+var retention RetentionPolicy
+
+var RetentionDisabledErr = errors.New("No retention policy was set when the server was started (see `asinkd start -h')")
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepVersions > 0 || p.TombstonesFor > 0
+}
+
+//The events describing one file (or directory, or symlink) from the time it
+//was created until it was deleted, following it when it was moved.
+type lineage struct {
+	versions  []*asink.Event //oldest first
+	tombstone *asink.Event   //the event which deleted or replaced it, nil if it still exists
+	movedBy   []*asink.Event //directory moves which moved it along with its parent
+}
+
+//Returns the ids of the events which policy allows to be dropped, given the
+//events in a share (or all of those affecting some of its paths), in order.
+//The events are replayed the same way a snapshot is built, so building one
+//from the remaining events gives the same result (except for forgotten
+//deleted files), and clients which apply the remaining events end up with the
+//same files.
+func compactableEvents(events []*asink.Event, policy RetentionPolicy, now time.Time) []int64 {
+	var lineages []*lineage
+	live := make(map[string]*lineage)
+	newLineage := func() *lineage {
+		l := new(lineage)
+		lineages = append(lineages, l)
+		return l
+	}
+	//ends the lineages at path (and inside it, for directories)
+	kill := func(path string, directory bool, tombstone *asink.Event) {
+		if l := live[path]; l != nil {
+			l.tombstone = tombstone
+			delete(live, path)
+		}
+		if directory {
+			prefix := path + "/"
+			for childPath, child := range live {
+				if strings.HasPrefix(childPath, prefix) {
+					child.tombstone = tombstone
+					delete(live, childPath)
+				}
+			}
+		}
+	}
+
+	for _, event := range events {
+		if event.IsMove() {
+			l := live[event.SourcePath]
+			delete(live, event.SourcePath)
+			if event.IsDirectory() {
+				moved := make(map[string]*lineage)
+				prefix := event.SourcePath + "/"
+				for childPath, child := range live {
+					if strings.HasPrefix(childPath, prefix) {
+						child.movedBy = append(child.movedBy, event)
+						moved[event.Path+"/"+strings.TrimPrefix(childPath, prefix)] = child
+						delete(live, childPath)
+					}
+				}
+				for childPath, child := range moved {
+					live[childPath] = child
+				}
+			}
+			kill(event.Path, false, event)
+			if l == nil {
+				l = newLineage()
+			}
+			l.versions = append(l.versions, event)
+			live[event.Path] = l
+		} else if event.IsUpdate() {
+			l := live[event.Path]
+			if l == nil {
+				l = newLineage()
+				live[event.Path] = l
+			}
+			l.versions = append(l.versions, event)
+		} else if event.IsDelete() {
+			if live[event.Path] == nil {
+				//deleting something which didn't exist still leaves a tombstone
+				newLineage().tombstone = event
+			}
+			kill(event.Path, event.IsDirectory(), event)
+		}
+	}
+
+	keep := make(map[int64]bool)
+	for _, l := range lineages {
+		if l.tombstone != nil && policy.TombstonesFor > 0 && now.Sub(time.Unix(0, l.tombstone.Timestamp)) > policy.TombstonesFor {
+			continue
+		}
+		if l.tombstone != nil {
+			keep[l.tombstone.Id] = true
+		}
+		for i, version := range l.versions {
+			newer := len(l.versions) - 1 - i
+			if policy.KeepVersions <= 0 || newer < policy.KeepVersions ||
+				(policy.KeepFor > 0 && now.Sub(time.Unix(0, version.Timestamp)) < policy.KeepFor) {
+				keep[version.Id] = true
+			}
+		}
+		//where the kept versions are depends on the directories they were
+		//moved along with
+		for _, move := range l.movedBy {
+			keep[move.Id] = true
+		}
+	}
+
+	var drop []int64
+	for _, event := range events {
+		if !keep[event.Id] {
+			drop = append(drop, event.Id)
+		}
+	}
+	return drop
+}
+
+type eventsById []*asink.Event
+
+func (e eventsById) Len() int           { return len(e) }
+func (e eventsById) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventsById) Less(i, j int) bool { return e[i].Id < e[j].Id }
+
+//Drops the events in share which the retention policy allows to be dropped,
+//returning how many were dropped. Rather than loading the share's whole
+//history at once, each path is compacted on its own, along with the
+//deletions of the directories containing it. Paths involved in moves are
+//compacted together, since their histories are intertwined.
+func compactShare(share *Share, policy RetentionPolicy) (int, error) {
+	//the share's latest event is always kept, so its ids are never reused
+	latestId, err := adb.DatabaseLatestEventId(share)
+	if err != nil {
+		return 0, err
+	}
+	structural, err := adb.DatabaseRetrieveStructuralEvents(share)
+	if err != nil {
+		return 0, err
+	}
+	var moveRoots []string
+	dirDeletes := make(map[string][]*asink.Event)
+	for _, event := range structural {
+		if event.IsMove() {
+			moveRoots = append(moveRoots, event.SourcePath, event.Path)
+		} else {
+			dirDeletes[event.Path] = append(dirDeletes[event.Path], event)
+		}
+	}
+	involvedInMove := func(p string) bool {
+		for _, root := range moveRoots {
+			if p == root || strings.HasPrefix(p, root+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	paths, err := adb.DatabaseGetEventPaths(share)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	dropped := 0
+	var moved []string
+	for _, p := range paths {
+		if involvedInMove(p) {
+			moved = append(moved, p)
+			continue
+		}
+		n, err := compactPaths(share, []string{p}, dirDeletes, latestId, policy, now)
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	n, err := compactPaths(share, moved, dirDeletes, latestId, policy, now)
+	return dropped + n, err
+}
+
+//Drops the events for paths which policy allows to be dropped, considering
+//them along with the deletions of the directories containing them (which are
+//only dropped along with their own paths)
+func compactPaths(share *Share, paths []string, dirDeletes map[string][]*asink.Event, latestId int64, policy RetentionPolicy, now time.Time) (int, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	own := make(map[string]bool)
+	byId := make(map[int64]*asink.Event)
+	for _, p := range paths {
+		own[p] = true
+		events, err := adb.DatabaseRetrievePathEvents(share, p)
+		if err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			byId[event.Id] = event
+		}
+		for dir := p; strings.Contains(dir, "/"); {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			for _, event := range dirDeletes[dir] {
+				byId[event.Id] = event
+			}
+		}
+	}
+	events := make([]*asink.Event, 0, len(byId))
+	for _, event := range byId {
+		events = append(events, event)
+	}
+	sort.Sort(eventsById(events))
+
+	var drop []int64
+	for _, id := range compactableEvents(events, policy, now) {
+		if id != latestId && own[byId[id].Path] {
+			drop = append(drop, id)
+		}
+	}
+	if len(drop) == 0 {
+		return 0, nil
+	}
+	err := adb.DatabaseDropEvents(share, drop)
+	if err != nil {
+		return 0, err
+	}
+	return len(drop), nil
+}
+
+//Compacts every share according to the retention policy, returning how many
+//events were dropped
+func CompactAllShares(policy RetentionPolicy) (int, error) {
+	if !policy.Enabled() {
+		return 0, nil
+	}
+	shares, err := adb.DatabaseGetAllShares()
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, share := range shares {
+		n, err := compactShare(share, policy)
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+//Compacts every share each interval until the server exits
+func StartCompacting(interval time.Duration) {
+	if !retention.Enabled() || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		dropped, err := CompactAllShares(retention)
+		if err != nil {
+			fmt.Println("Error compacting events: " + err.Error())
+		} else if dropped > 0 {
+			fmt.Printf("Compaction dropped %d events\n", dropped)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/aclindsa/asink"
+	"net/rpc"
+	"os"
+)
+
+func Compact(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	i := 99
+	dropped := 0
+	err := asink.RPCCall(*rpcSocket, "Compactor.Compact", &i, &dropped)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok && err.Error() == RetentionDisabledErr.Error() {
+			fmt.Println("Error: " + err.Error())
+			os.Exit(1)
+		}
+		panic(err)
+	}
+	fmt.Printf("Dropped %d events\n", dropped)
+}
+
+func DroppedHashes(args []string) {
+	flags := flag.NewFlagSet("droppedhashes", flag.ExitOnError)
+	forget := flags.Bool("forget", false, "Forget the hashes given as arguments, once their files have been removed from storage")
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if *forget {
+		if flags.NArg() == 0 {
+			fmt.Println("Error: please supply the hashes to forget")
+			os.Exit(1)
+		}
+		hashes := flags.Args()
+		i := 99
+		err := asink.RPCCall(*rpcSocket, "Compactor.ForgetDroppedHashes", &hashes, &i)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	i := 99
+	var hashes []string
+	err := asink.RPCCall(*rpcSocket, "Compactor.GetDroppedHashes", &i, &hashes)
+	if err != nil {
+		panic(err)
+	}
+	for _, hash := range hashes {
+		fmt.Println(hash)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"testing"
+	"time"
+)
+
+var compactionNow = time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+
+//an event with the given id, made the given time before compactionNow
+func compactionEvent(id int64, eventType asink.EventType, path, source string, age time.Duration) *asink.Event {
+	event := new(asink.Event)
+	event.Id = id
+	event.Type = eventType
+	event.Path = path
+	event.SourcePath = source
+	if eventType&asink.UPDATE != 0 {
+		event.Hash = path + string('a'+byte(id))
+	}
+	event.Timestamp = compactionNow.Add(-age).UnixNano()
+	return event
+}
+
+func TestCompactableEvents(t *testing.T) {
+	const day = 24 * time.Hour
+	update, del := asink.EventType(asink.UPDATE), asink.EventType(asink.DELETE)
+	move := asink.EventType(asink.UPDATE | asink.MOVE)
+	dirUpdate := asink.EventType(asink.UPDATE | asink.DIRECTORY)
+	dirDelete := asink.EventType(asink.DELETE | asink.DIRECTORY)
+	dirMove := asink.EventType(asink.UPDATE | asink.MOVE | asink.DIRECTORY)
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		events []*asink.Event
+		drop   []int64
+	}{
+		{
+			"no policy",
+			RetentionPolicy{},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 3*day),
+				compactionEvent(2, update, "a", "", 2*day),
+				compactionEvent(3, del, "a", "", day),
+			},
+			nil,
+		},
+		{
+			"latest versions",
+			RetentionPolicy{KeepVersions: 2},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 4*day),
+				compactionEvent(2, update, "b", "", 4*day),
+				compactionEvent(3, update, "a", "", 3*day),
+				compactionEvent(4, update, "a", "", 2*day),
+				compactionEvent(5, update, "a", "", day),
+			},
+			[]int64{1, 3},
+		},
+		{
+			"recent versions",
+			RetentionPolicy{KeepVersions: 1, KeepFor: 36 * time.Hour},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 3*day),
+				compactionEvent(2, update, "a", "", 2*day),
+				compactionEvent(3, update, "a", "", day),
+				compactionEvent(4, update, "a", "", time.Hour),
+			},
+			[]int64{1, 2},
+		},
+		{
+			"deleted files",
+			RetentionPolicy{KeepVersions: 1, TombstonesFor: 2 * day},
+			[]*asink.Event{
+				compactionEvent(1, update, "old", "", 5*day),
+				compactionEvent(2, update, "old", "", 4*day),
+				compactionEvent(3, del, "old", "", 3*day),
+				compactionEvent(4, update, "recent", "", 3*day),
+				compactionEvent(5, update, "recent", "", 2*day),
+				compactionEvent(6, del, "recent", "", day),
+				compactionEvent(7, del, "never", "", 3*day),
+			},
+			[]int64{1, 2, 3, 4, 7},
+		},
+		{
+			"recreated files",
+			RetentionPolicy{KeepVersions: 1, TombstonesFor: 2 * day},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 5*day),
+				compactionEvent(2, del, "a", "", 4*day),
+				compactionEvent(3, update, "a", "", 3*day),
+				compactionEvent(4, update, "a", "", 2*day),
+			},
+			[]int64{1, 2, 3},
+		},
+		{
+			"deleted directories",
+			RetentionPolicy{KeepVersions: 1, TombstonesFor: 2 * day},
+			[]*asink.Event{
+				compactionEvent(1, dirUpdate, "d", "", 5*day),
+				compactionEvent(2, update, "d/f", "", 5*day),
+				compactionEvent(3, update, "d/e/g", "", 5*day),
+				compactionEvent(4, dirDelete, "d", "", 3*day),
+				compactionEvent(5, update, "dd/f", "", 3*day),
+			},
+			[]int64{1, 2, 3, 4},
+		},
+		{
+			"moved files",
+			RetentionPolicy{KeepVersions: 2},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 4*day),
+				compactionEvent(2, update, "a", "", 3*day),
+				compactionEvent(3, move, "b", "a", 2*day),
+				compactionEvent(4, update, "b", "", day),
+			},
+			[]int64{1, 2},
+		},
+		{
+			"moved over another file",
+			RetentionPolicy{KeepVersions: 1, TombstonesFor: 2 * day},
+			[]*asink.Event{
+				compactionEvent(1, update, "a", "", 4*day),
+				compactionEvent(2, update, "b", "", 4*day),
+				compactionEvent(3, move, "b", "a", 3*day),
+			},
+			[]int64{1, 2},
+		},
+		{
+			"moved directories",
+			RetentionPolicy{KeepVersions: 1},
+			[]*asink.Event{
+				compactionEvent(1, dirUpdate, "d", "", 4*day),
+				compactionEvent(2, update, "d/f", "", 4*day),
+				compactionEvent(3, update, "d/f", "", 3*day),
+				compactionEvent(4, dirMove, "e", "d", 2*day),
+				compactionEvent(5, update, "e/g", "", day),
+			},
+			[]int64{1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		drop := compactableEvents(test.events, test.policy, compactionNow)
+		if len(drop) != len(test.drop) {
+			t.Errorf("%s: dropped %v, expected %v", test.name, drop, test.drop)
+			continue
+		}
+		for i := range drop {
+			if drop[i] != test.drop[i] {
+				t.Errorf("%s: dropped %v, expected %v", test.name, drop, test.drop)
+				break
+			}
+		}
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/aclindsa/asink"
+	"github.com/aclindsa/asink/util"
 	_ "github.com/mattn/go-sqlite3"
+	"strings"
 	"sync"
+	"time"
 )
 
 type AsinkDB struct {
@@ -19,6 +22,27 @@ type AsinkDB struct {
 
 var DuplicateUsernameErr = errors.New("Username already exists")
 var NoUserErr = errors.New("User doesn't exist")
+var InvalidShareNameErr = errors.New("Share names may only contain letters, numbers, '_', '.', and '-'")
+var DuplicateShareErr = errors.New("User already belongs to a share with that name")
+var NoShareErr = errors.New("Share doesn't exist")
+var NoShareMemberErr = errors.New("User isn't a member of that share")
+var ShareOwnerErr = errors.New("The owner's role in a share can't be changed")
+var NoDeviceErr = errors.New("User has no device with that id")
+var NewPasswordRequiredErr = errors.New("A new password is required to revoke a device")
+
+//columns added to the events table since it was first created, and their
+//definitions
+var eventColumnUpgrades = [][2]string{
+	{"sourcepath", "TEXT NOT NULL DEFAULT ''"},
+	{"linktarget", "TEXT NOT NULL DEFAULT ''"},
+	{"mtime", "INTEGER NOT NULL DEFAULT 0"},
+	{"xattrs", "TEXT NOT NULL DEFAULT ''"},
+	{"shareid", "INTEGER NOT NULL DEFAULT 0"},
+	{"eventid", "INTEGER NOT NULL DEFAULT 0"}, //the id of the event within its share
+	{"uuid", "TEXT NOT NULL DEFAULT ''"},
+	{"deviceid", "INTEGER NOT NULL DEFAULT 0"}, //the device the event came from, 0 if unknown
+	{"clock", "INTEGER NOT NULL DEFAULT 0"},
+}
 
 func GetAndInitDB() (*AsinkDB, error) {
 	dbLocation := "asink-server.db" //TODO make me configurable
@@ -47,6 +71,27 @@ func GetAndInitDB() (*AsinkDB, error) {
 		rows.Close()
 	}
 
+	//upgrade events tables created by previous versions
+	for _, column := range eventColumnUpgrades {
+		err = util.EnsureColumnExists(tx, "events", column[0], column[1])
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	//events added before they had clocks are ordered by their timestamps,
+	//as they were before
+	_, err = tx.Exec("UPDATE events SET clock = timestamp WHERE clock = 0;")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	tx.Exec("CREATE INDEX IF NOT EXISTS shareeventidx on events (shareid, eventid);")
+	tx.Exec("CREATE INDEX IF NOT EXISTS shareuuididx on events (shareid, uuid);")
+	tx.Exec("CREATE INDEX IF NOT EXISTS hashidx on events (hash);")
+
 	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='users';")
 	if err != nil {
 		return nil, err
@@ -57,6 +102,71 @@ func GetAndInitDB() (*AsinkDB, error) {
 	} else {
 		rows.Close()
 	}
+	err = util.EnsureColumnExists(tx, "users", "requiredevices", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='shares';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE shares (id INTEGER PRIMARY KEY ASC, userid INTEGER, name TEXT);")
+		tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS shareuseridx on shares (userid, name);")
+	} else {
+		rows.Close()
+	}
+
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='sharemembers';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE sharemembers (shareid INTEGER, userid INTEGER, role INTEGER);")
+		tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS sharememberidx on sharemembers (shareid, userid);")
+	} else {
+		rows.Close()
+	}
+
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='devices';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE devices (id INTEGER PRIMARY KEY ASC, userid INTEGER, name TEXT, tokenhash TEXT, created INTEGER, revoked INTEGER);")
+		tx.Exec("CREATE INDEX IF NOT EXISTS deviceuseridx on devices (userid);")
+	} else {
+		rows.Close()
+	}
+
+	rows, err = tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='droppedhashes';")
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		//if this is false, it means no rows were returned
+		tx.Exec("CREATE TABLE droppedhashes (hash TEXT PRIMARY KEY, timestamp INTEGER);")
+	} else {
+		rows.Close()
+	}
+
+	err = upgradeEventsToShares(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	//shares created before they could have members belong to their owners
+	_, err = tx.Exec("INSERT INTO sharemembers (shareid, userid, role) SELECT id, userid, ? FROM shares WHERE NOT EXISTS (SELECT 1 FROM sharemembers WHERE sharemembers.shareid = shares.id AND sharemembers.userid = shares.userid);", asink.OWNER)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	err = tx.Commit()
 	if err != nil {
@@ -68,10 +178,229 @@ func GetAndInitDB() (*AsinkDB, error) {
 	return ret, nil
 }
 
-func (adb *AsinkDB) DatabaseAddEvents(u *User, events []*asink.Event) (err error) {
+//Events created before shares existed belong to their user's default share.
+//They keep their original ids, which are unique across all shares, so
+//clients which have already seen them don't need to start over.
+func upgradeEventsToShares(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT DISTINCT userid FROM events WHERE shareid = 0;")
+	if err != nil {
+		return err
+	}
+	var userIds []int64
+	for rows.Next() {
+		var userId int64
+		err = rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+
+	for _, userId := range userIds {
+		share, err := getShare(tx, userId, asink.DEFAULT_SHARE)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE events SET shareid = ?, eventid = id WHERE userid = ? AND shareid = 0;", share.Id, userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Returns the share named name to which the user with id userId belongs, or
+//nil if there isn't one
+func findShare(tx *sql.Tx, userId int64, name string) (*Share, error) {
+	share := new(Share)
+	row := tx.QueryRow("SELECT shares.id, shares.userid, shares.name, sharemembers.role FROM shares JOIN sharemembers ON shares.id = sharemembers.shareid WHERE sharemembers.userid = ? AND shares.name = ?;", userId, name)
+	err := row.Scan(&share.Id, &share.UserId, &share.Name, &share.Role)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		return share, nil
+	}
+}
+
+//Creates a share named name, owned by the user with id userId
+func addShare(tx *sql.Tx, userId int64, name string) (*Share, error) {
+	result, err := tx.Exec("INSERT INTO shares (userid, name) VALUES (?,?);", userId, name)
+	if err != nil {
+		return nil, err
+	}
+	share := new(Share)
+	share.Id, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO sharemembers (shareid, userid, role) VALUES (?,?,?);", share.Id, userId, asink.OWNER)
+	if err != nil {
+		return nil, err
+	}
+	share.UserId = userId
+	share.Name = name
+	share.Role = asink.OWNER
+	return share, nil
+}
+
+//Returns the share named name to which the user with id userId belongs,
+//creating it if it doesn't yet exist
+func getShare(tx *sql.Tx, userId int64, name string) (*Share, error) {
+	share, err := findShare(tx, userId, name)
+	if err != nil || share != nil {
+		return share, err
+	}
+	return addShare(tx, userId, name)
+}
+
+//Returns the share named name to which u belongs, creating it (owned by u)
+//if this is the first time it has been used
+func (adb *AsinkDB) DatabaseGetShare(u *User, name string) (share *Share, err error) {
+	if !asink.ValidShareName(name) {
+		return nil, InvalidShareNameErr
+	}
+
 	adb.lock.Lock()
 	tx, err := adb.db.Begin()
 	if err != nil {
+		adb.lock.Unlock()
+		return nil, err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	share, err = getShare(tx, u.Id, name)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+//Creates a share named name owned by u
+func (adb *AsinkDB) DatabaseAddShare(u *User, name string) (share *Share, err error) {
+	if !asink.ValidShareName(name) {
+		return nil, InvalidShareNameErr
+	}
+
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		adb.lock.Unlock()
+		return nil, err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	existing, err := findShare(tx, u.Id, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, DuplicateShareErr
+	}
+	share, err = addShare(tx, u.Id, name)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+//Returns the share named name owned by u, without creating it
+func (adb *AsinkDB) DatabaseGetOwnedShare(u *User, name string) (*Share, error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	share := new(Share)
+	row := adb.db.QueryRow("SELECT id, userid, name FROM shares WHERE userid = ? AND name = ?;", u.Id, name)
+	err := row.Scan(&share.Id, &share.UserId, &share.Name)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, NoShareErr
+	case err != nil:
+		return nil, err
+	default:
+		share.Role = asink.OWNER
+		return share, nil
+	}
+}
+
+//Adds u to share with the given role, or changes its role if u is already a
+//member
+func (adb *AsinkDB) DatabaseSetShareMember(share *Share, u *User, role asink.ShareRole) (err error) {
+	if u.Id == share.UserId {
+		return ShareOwnerErr
+	}
+
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		adb.lock.Unlock()
+		return err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	//shares are referred to by name, so they must be unambiguous
+	existing, err := findShare(tx, u.Id, share.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Id != share.Id {
+		return DuplicateShareErr
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO sharemembers (shareid, userid, role) VALUES (?,?,?);", share.Id, u.Id, role)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (adb *AsinkDB) DatabaseRemoveShareMember(share *Share, u *User) (err error) {
+	if u.Id == share.UserId {
+		return ShareOwnerErr
+	}
+
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		adb.lock.Unlock()
 		return err
 	}
 
@@ -83,17 +412,415 @@ func (adb *AsinkDB) DatabaseAddEvents(u *User, events []*asink.Event) (err error
 		adb.lock.Unlock()
 	}()
 
-	for _, e := range events {
-		result, err := tx.Exec("INSERT INTO events (userid, type, path, hash, predecessor, timestamp, permissions) VALUES (?,?,?,?,?,?,?);", u.Id, e.Type, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions)
+	res, err := tx.Exec("DELETE FROM sharemembers WHERE shareid = ? AND userid = ?;", share.Id, u.Id)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return NoShareMemberErr
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (adb *AsinkDB) DatabaseGetShareMembers(share *Share) (members []*ShareMember, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT users.username, sharemembers.role FROM sharemembers JOIN users ON sharemembers.userid = users.id WHERE sharemembers.shareid = ? ORDER BY users.username ASC;", share.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		member := new(ShareMember)
+		err = rows.Scan(&member.Username, &member.Role)
 		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (adb *AsinkDB) DatabaseGetAllShares() (shares []*Share, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT id, userid, name FROM shares ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		share := new(Share)
+		err = rows.Scan(&share.Id, &share.UserId, &share.Name)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+//Registers a new device for u, returning it along with the token it should
+//authenticate with
+func (adb *AsinkDB) DatabaseAddDevice(u *User, name string) (device *Device, token string, err error) {
+	token, err = NewDeviceToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	device = &Device{UserId: u.Id, Name: name, TokenHash: HashPassword(token), Created: time.Now().UnixNano()}
+	result, err := adb.db.Exec("INSERT INTO devices (userid, name, tokenhash, created, revoked) VALUES (?,?,?,?,?);", device.UserId, device.Name, device.TokenHash, device.Created, device.Revoked)
+	if err != nil {
+		return nil, "", err
+	}
+	device.Id, err = result.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+	return device, token, nil
+}
+
+func (adb *AsinkDB) DatabaseGetDevice(u *User, id int64) (device *Device, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT id, userid, name, tokenhash, created, revoked FROM devices WHERE userid = ? AND id = ?;", u.Id, id)
+
+	device = new(Device)
+	err = row.Scan(&device.Id, &device.UserId, &device.Name, &device.TokenHash, &device.Created, &device.Revoked)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, NoDeviceErr
+	case err != nil:
+		return nil, err
+	default:
+		return device, nil
+	}
+}
+
+func (adb *AsinkDB) DatabaseGetDevices(u *User) (devices []*Device, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT id, userid, name, tokenhash, created, revoked FROM devices WHERE userid = ? ORDER BY id ASC;", u.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		device := new(Device)
+		err = rows.Scan(&device.Id, &device.UserId, &device.Name, &device.TokenHash, &device.Created, &device.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+//Revokes one of u's devices, changing u's password to pwhash at the same time
+func (adb *AsinkDB) DatabaseRevokeDevice(u *User, id int64, pwhash string) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		adb.lock.Unlock()
+		return err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	result, err := tx.Exec("UPDATE devices SET revoked = 1 WHERE userid = ? AND id = ?;", u.Id, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = NoDeviceErr
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET pwhash = ? WHERE id = ?;", pwhash, u.Id)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
+
+//Adds events, submitted by u, to share. Each is assigned the next id in the
+//share's sequence, unless it has the same UUID as an event already in the
+//share (i.e. because the client sent it again after not hearing back from
+//us), in which case it isn't added again and is given that event's id.
+//device is the device they were submitted from, or nil if it is unknown.
+//Events whose predecessor isn't the current version of their path are not
+//added, and the current version is returned in their place in conflicts (as
+//a deletion if the path doesn't exist).
+func (adb *AsinkDB) DatabaseAddEvents(u *User, device *Device, share *Share, events []*asink.Event) (conflicts []*asink.Event, err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	var deviceId int64
+	var deviceName string
+	if device != nil {
+		deviceId = device.Id
+		deviceName = device.Name
+	}
+
+	var latestId int64
+	row := tx.QueryRow("SELECT COALESCE(MAX(eventid), 0) FROM events WHERE shareid = ?;", share.Id)
+	err = row.Scan(&latestId)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts = make([]*asink.Event, len(events))
+	for i, e := range events {
+		if e.UUID != "" {
+			var existingId int64
+			row := tx.QueryRow("SELECT eventid FROM events WHERE shareid = ? AND uuid = ?;", share.Id, e.UUID)
+			err = row.Scan(&existingId)
+			if err == nil {
+				e.Id = existingId
+				e.Sharename = share.Name
+				e.Username = u.Username
+				e.Device = deviceName
+				continue
+			} else if err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+
+		//the event must have been made from the current version, unless
+		//it's deleting something which is already gone
+		head, err := pathHead(tx, share.Id, e.Path, latestId+1)
+		if err != nil {
+			return nil, err
+		}
+		if head == nil {
+			if e.Predecessor != "" && !e.IsDelete() {
+				conflicts[i] = &asink.Event{Type: asink.DELETE, Path: e.Path}
+				continue
+			}
+		} else if head.Hash != e.Predecessor {
+			conflicts[i] = head
+			continue
+		}
+
+		//clients which predate clocks only send timestamps
+		if e.Clock == 0 {
+			e.Clock = e.Timestamp
+		}
+
+		latestId++
+		_, err = tx.Exec("INSERT INTO events (userid, shareid, eventid, type, path, hash, predecessor, timestamp, permissions, sourcepath, linktarget, mtime, xattrs, uuid, deviceid, clock) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);", u.Id, share.Id, latestId, e.Type, e.Path, e.Hash, e.Predecessor, e.Timestamp, e.Permissions, e.SourcePath, e.LinkTarget, e.MTime, e.Xattrs, e.UUID, deviceId, e.Clock)
+		if err != nil {
+			return nil, err
+		}
+
+		//a hash which is used again can't be cleaned up after all
+		if e.Hash != "" {
+			_, err = tx.Exec("DELETE FROM droppedhashes WHERE hash = ?;", e.Hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		e.Id = latestId
+		e.Sharename = share.Name
+		e.Username = u.Username
+		e.Device = deviceName
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+//Returns the latest event for path in the share with id shareId as of just
+//before the event with id 'before', or nil if nothing existed there. Files
+//moved or deleted along with a parent directory are followed.
+func pathHead(tx *sql.Tx, shareId int64, path string, before int64) (*asink.Event, error) {
+	head := new(asink.Event)
+	row := tx.QueryRow("SELECT events.eventid, events.type, events.path, events.hash, events.timestamp, events.clock, COALESCE(users.username, ''), COALESCE(devices.name, '') FROM events LEFT JOIN users ON events.userid = users.id LEFT JOIN devices ON events.deviceid = devices.id WHERE events.shareid = ? AND events.eventid < ? AND (events.path = ? OR (events.sourcepath = ? AND events.type & ? != 0)) ORDER BY events.eventid DESC LIMIT 1;", shareId, before, path, path, asink.MOVE)
+	err := row.Scan(&head.Id, &head.Type, &head.Path, &head.Hash, &head.Timestamp, &head.Clock, &head.Username, &head.Device)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	//find the latest directory deleted or moved since then which contained it
+	var parents []interface{}
+	for dir := path; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndex(dir, "/")]
+		parents = append(parents, dir)
+	}
+	if len(parents) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(parents)), ",")
+		args := []interface{}{shareId, before, head.Id, asink.DIRECTORY, asink.DELETE | asink.MOVE}
+		args = append(append(args, parents...), parents...)
+		var dirType asink.EventType
+		var dirId int64
+		var dirPath, dirSource string
+		row = tx.QueryRow("SELECT eventid, type, path, sourcepath FROM events WHERE shareid = ? AND eventid < ? AND eventid > ? AND type & ? != 0 AND type & ? != 0 AND (path IN ("+placeholders+") OR sourcepath IN ("+placeholders+")) ORDER BY eventid DESC LIMIT 1;", args...)
+		err = row.Scan(&dirId, &dirType, &dirPath, &dirSource)
+		if err == nil {
+			if dirType&asink.MOVE != 0 && strings.HasPrefix(path, dirPath+"/") {
+				//it was moved here along with this directory
+				head, err = pathHead(tx, shareId, dirSource+strings.TrimPrefix(path, dirPath), dirId)
+				if head != nil {
+					head.Path = path
+				}
+				return head, err
+			}
+			return nil, nil
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if head.Id == 0 || head.Path != path || head.IsDelete() {
+		return nil, nil
+	}
+	return head, nil
+}
+
+//Removes the events in share with the given ids. The hashes of any files
+//which are no longer referred to by any event are added to the dropped
+//hashes, so they can be removed from storage.
+func (adb *AsinkDB) DatabaseDropEvents(share *Share, ids []int64) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	hashes := make(map[string]bool)
+	for _, id := range ids {
+		var hash string
+		row := tx.QueryRow("SELECT hash FROM events WHERE shareid = ? AND eventid = ?;", share.Id, id)
+		err = row.Scan(&hash)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		} else if err != nil {
 			return err
 		}
-		id, err := result.LastInsertId()
+		if hash != "" {
+			hashes[hash] = true
+		}
+		_, err = tx.Exec("DELETE FROM events WHERE shareid = ? AND eventid = ?;", share.Id, id)
 		if err != nil {
 			return err
 		}
+	}
+
+	now := time.Now().UnixNano()
+	for hash := range hashes {
+		_, err = tx.Exec("INSERT OR IGNORE INTO droppedhashes (hash, timestamp) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM events WHERE hash = ?);", hash, now, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//Returns the hashes of the files which are no longer referred to by any
+//event since they were compacted away, oldest first
+func (adb *AsinkDB) DatabaseGetDroppedHashes() (hashes []string, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT hash FROM droppedhashes ORDER BY timestamp ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
 
-		e.Id = id
+//Removes hashes from the dropped hashes, once their files have been removed
+//from storage
+func (adb *AsinkDB) DatabaseForgetDroppedHashes(hashes []string) (err error) {
+	adb.lock.Lock()
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	//make sure the transaction gets rolled back on error, and the database gets unlocked
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+		adb.lock.Unlock()
+	}()
+
+	for _, hash := range hashes {
+		_, err = tx.Exec("DELETE FROM droppedhashes WHERE hash = ?;", hash)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = tx.Commit()
@@ -103,22 +830,82 @@ func (adb *AsinkDB) DatabaseAddEvents(u *User, events []*asink.Event) (err error
 	return nil
 }
 
-func (adb *AsinkDB) DatabaseRetrieveEvents(firstId uint64, maxEvents uint, u *User) (events []*asink.Event, err error) {
+//returns 0 if share has no events
+func (adb *AsinkDB) DatabaseLatestEventId(share *Share) (latestId int64, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	row := adb.db.QueryRow("SELECT COALESCE(MAX(eventid), 0) FROM events WHERE shareid = ?;", share.Id)
+	err = row.Scan(&latestId)
+	return latestId, err
+}
+
+func (adb *AsinkDB) DatabaseRetrieveEvents(firstId uint64, maxEvents uint, share *Share) (events []*asink.Event, err error) {
 	adb.lock.Lock()
 	//make sure the database gets unlocked on return
 	defer func() {
 		adb.lock.Unlock()
 	}()
-	rows, err := adb.db.Query("SELECT id, type, path, hash, predecessor, timestamp, permissions FROM events WHERE userid = ? AND id >= ? ORDER BY id ASC LIMIT ?;", u.Id, firstId, maxEvents)
+	return adb.queryEvents(share, "events.eventid >= ? ORDER BY events.eventid ASC LIMIT ?", firstId, maxEvents)
+}
+
+//Returns the events in share for path, oldest first
+func (adb *AsinkDB) DatabaseRetrievePathEvents(share *Share, path string) (events []*asink.Event, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	return adb.queryEvents(share, "events.path = ? ORDER BY events.eventid ASC", path)
+}
+
+//Returns the moves and directory deletions in share, oldest first
+func (adb *AsinkDB) DatabaseRetrieveStructuralEvents(share *Share) (events []*asink.Event, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	return adb.queryEvents(share, "(events.type & ? != 0 OR (events.type & ? != 0 AND events.type & ? != 0)) ORDER BY events.eventid ASC", asink.MOVE, asink.DIRECTORY, asink.DELETE)
+}
+
+//Returns each path in share which has any events
+func (adb *AsinkDB) DatabaseGetEventPaths(share *Share) (paths []string, err error) {
+	adb.lock.Lock()
+	//make sure the database gets unlocked
+	defer adb.lock.Unlock()
+
+	rows, err := adb.db.Query("SELECT DISTINCT path FROM events WHERE shareid = ? ORDER BY path ASC;", share.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+//Returns the events in share matching conditions, which may also order and
+//limit them. The database must already be locked.
+func (adb *AsinkDB) queryEvents(share *Share, conditions string, args ...interface{}) (events []*asink.Event, err error) {
+	args = append([]interface{}{share.Id}, args...)
+	rows, err := adb.db.Query("SELECT events.eventid, events.type, events.path, events.hash, events.predecessor, events.timestamp, events.permissions, events.sourcepath, events.linktarget, events.mtime, events.xattrs, events.uuid, COALESCE(users.username, ''), COALESCE(devices.name, ''), events.clock FROM events LEFT JOIN users ON events.userid = users.id LEFT JOIN devices ON events.deviceid = devices.id WHERE events.shareid = ? AND "+conditions+";", args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var event asink.Event
-		err = rows.Scan(&event.Id, &event.Type, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions)
+		err = rows.Scan(&event.Id, &event.Type, &event.Path, &event.Hash, &event.Predecessor, &event.Timestamp, &event.Permissions, &event.SourcePath, &event.LinkTarget, &event.MTime, &event.Xattrs, &event.UUID, &event.Username, &event.Device, &event.Clock)
 		if err != nil {
 			return nil, err
 		}
+		event.Sharename = share.Name
 		events = append(events, &event)
 	}
 
@@ -153,7 +940,7 @@ func (adb *AsinkDB) DatabaseAddUser(u *User) (err error) {
 		return DuplicateUsernameErr
 	}
 
-	result, err := tx.Exec("INSERT INTO users (username, pwhash, role) VALUES (?,?,?);", u.Username, u.PWHash, u.Role)
+	result, err := tx.Exec("INSERT INTO users (username, pwhash, role, requiredevices) VALUES (?,?,?,?);", u.Username, u.PWHash, u.Role, u.RequireDevices)
 	if err != nil {
 		return err
 	}
@@ -198,7 +985,7 @@ func (adb *AsinkDB) DatabaseUpdateUser(u *User) (err error) {
 		return DuplicateUsernameErr
 	}
 
-	_, err = tx.Exec("UPDATE users SET username=?, pwhash=?, role=? WHERE id=?;", u.Username, u.PWHash, u.Role, u.Id)
+	_, err = tx.Exec("UPDATE users SET username=?, pwhash=?, role=?, requiredevices=? WHERE id=?;", u.Username, u.PWHash, u.Role, u.RequireDevices, u.Id)
 	if err != nil {
 		return err
 	}
@@ -215,10 +1002,10 @@ func (adb *AsinkDB) DatabaseGetUser(username string) (user *User, err error) {
 	//make sure the database gets unlocked
 	defer adb.lock.Unlock()
 
-	row := adb.db.QueryRow("SELECT id, username, pwhash, role FROM users WHERE username == ?;", username)
+	row := adb.db.QueryRow("SELECT id, username, pwhash, role, requiredevices FROM users WHERE username == ?;", username)
 
 	user = new(User)
-	err = row.Scan(&user.Id, &user.Username, &user.PWHash, &user.Role)
+	err = row.Scan(&user.Id, &user.Username, &user.PWHash, &user.Role, &user.RequireDevices)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -0,0 +1,98 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"code.google.com/p/gopass"
+	"flag"
+	"fmt"
+	"github.com/aclindsa/asink"
+	"net/rpc"
+	"os"
+	"strconv"
+	"time"
+)
+
+//errors which are the user's fault, and shouldn't cause a panic
+var deviceAdminErrs = []error{NoUserErr, NoDeviceErr, NewPasswordRequiredErr}
+
+func deviceRPCCall(rpcSocket, method string, args *DeviceModifierArgs, reply interface{}) {
+	err := asink.RPCCall(rpcSocket, method, args, reply)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			for _, e := range deviceAdminErrs {
+				if err.Error() == e.Error() {
+					fmt.Println("Error: " + err.Error())
+					os.Exit(1)
+				}
+			}
+		}
+		panic(err)
+	}
+}
+
+func Devices(args []string) {
+	flags := flag.NewFlagSet("devices", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("Error: please supply the username whose devices to list")
+		os.Exit(1)
+	}
+
+	rpcargs := new(DeviceModifierArgs)
+	rpcargs.Username = flags.Arg(0)
+
+	var devices []*Device
+	deviceRPCCall(*rpcSocket, "UserModifier.GetDevices", rpcargs, &devices)
+	for _, device := range devices {
+		status := ""
+		if device.Revoked {
+			status = "\trevoked"
+		}
+		fmt.Printf("%d\t%s\tregistered %s%s\n", device.Id, device.Name, time.Unix(0, device.Created).Format(time.RFC1123), status)
+	}
+}
+
+func DeviceRevoke(args []string) {
+	flags := flag.NewFlagSet("devicerevoke", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println("Error: please supply the username and the id of the device to revoke (see `asinkd devices')")
+		os.Exit(1)
+	}
+
+	rpcargs := new(DeviceModifierArgs)
+	rpcargs.Username = flags.Arg(0)
+	id, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+	if err != nil {
+		fmt.Println("Error: invalid device id: " + flags.Arg(1))
+		os.Exit(1)
+	}
+	rpcargs.DeviceId = id
+
+	//a revoked device still knows the user's password, with which it could
+	//register itself again, so it has to be changed at the same time
+	fmt.Println("Revoking a device also changes its user's password, which their other devices will then need to be given.")
+	passwordOne, err := gopass.GetPass("Enter new password for user: ")
+	if err != nil {
+		panic(err)
+	}
+	passwordTwo, err := gopass.GetPass("Enter the same password again: ")
+	if err != nil {
+		panic(err)
+	}
+	if passwordOne != passwordTwo {
+		fmt.Println("Error: Passwords do not match. Please try again.")
+		os.Exit(1)
+	}
+	rpcargs.PWHash = HashPassword(passwordOne)
+
+	i := 99
+	deviceRPCCall(*rpcSocket, "UserModifier.RevokeDevice", rpcargs, &i)
+}
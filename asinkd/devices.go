@@ -0,0 +1,35 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+//A machine a user has registered to synchronize from. Requests made with a
+//revoked device's credentials are refused.
+type Device struct {
+	Id        int64
+	UserId    int64
+	Name      string
+	TokenHash string
+	Created   int64 //when the device was registered, in nanoseconds since the epoch
+	Revoked   bool
+}
+
+//Returns a new random token for a device to authenticate with
+func NewDeviceToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func (d *Device) ValidToken(token string) bool {
+	return HashPassword(token) == d.TokenHash
+}
@@ -5,76 +5,61 @@
 package main
 
 import (
-	"github.com/aclindsa/asink"
 	"sync"
-	"time"
 )
 
-type LongPollGroup struct {
-	channels []*chan *asink.Event
-	lock     sync.Mutex
-}
-
+//Keeps track of the clients waiting (by long polling or streaming) for new
+//events in each share. Pollers are only told that there are new events; they
+//retrieve the events themselves so none are missed, no matter how many are
+//added at once.
 type PollingManager struct {
-	lock   sync.RWMutex
-	groups map[int64]*LongPollGroup
+	lock   sync.Mutex
+	groups map[int64][]chan int //keyed by share id
 }
 
 var pm *PollingManager
 
 func init() {
 	pm = new(PollingManager)
-	pm.groups = make(map[int64]*LongPollGroup)
+	pm.groups = make(map[int64][]chan int)
 }
 
-func addPoller(uid int64, channel *chan *asink.Event) {
-	pm.lock.RLock()
+//Returns a channel which receives a value whenever new events are added to
+//the share. It must be passed to removePoller() once it is no longer needed.
+func addPoller(shareId int64) chan int {
+	channel := make(chan int, 1)
+	pm.lock.Lock()
+	pm.groups[shareId] = append(pm.groups[shareId], channel)
+	pm.lock.Unlock()
+	return channel
+}
 
-	group := pm.groups[uid]
-	if group != nil {
-		group.lock.Lock()
-		pm.lock.RUnlock()
-		group.channels = append(group.channels, channel)
-		group.lock.Unlock()
+func removePoller(shareId int64, channel chan int) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	group := pm.groups[shareId]
+	for i, c := range group {
+		if c == channel {
+			copy(group[i:], group[i+1:])
+			group = group[:len(group)-1]
+			break
+		}
+	}
+	if len(group) == 0 {
+		delete(pm.groups, shareId)
 	} else {
-		pm.lock.RUnlock()
-		pm.lock.Lock()
-		group = new(LongPollGroup)
-		group.channels = append(group.channels, channel)
-		pm.groups[uid] = group
-		pm.lock.Unlock()
+		pm.groups[shareId] = group
 	}
-
-	//set timer to call function after one minute
-	timeout := time.Duration(1) * time.Minute
-	time.AfterFunc(timeout, func() {
-		group.lock.Lock()
-		for i, c := range group.channels {
-			if c == channel {
-				copy(group.channels[i:], group.channels[i+1:])
-				group.channels = group.channels[:len(group.channels)-1]
-				break
-			}
-		}
-		group.lock.Unlock()
-		close(*channel)
-	})
 }
 
-func broadcastToPollers(uid int64, event *asink.Event) {
-	//store off the long polling group we're trying to send to and remove
-	//it from PollingManager.groups
+func broadcastToPollers(shareId int64) {
 	pm.lock.Lock()
-	group := pm.groups[uid]
-	pm.groups[uid] = nil
-	pm.lock.Unlock()
-
-	//send event down each of group's channels
-	if group != nil {
-		group.lock.Lock()
-		for _, c := range group.channels {
-			*c <- event
+	defer pm.lock.Unlock()
+	for _, c := range pm.groups[shareId] {
+		//if there's already a notification waiting, this one isn't needed
+		select {
+		case c <- 0:
+		default:
 		}
-		group.lock.Unlock()
 	}
 }
@@ -42,6 +42,46 @@ var commands []Command = []Command{
 		fn:          UserMod,
 		explanation: "Modify a user",
 	},
+	Command{
+		cmd:         "shareadd",
+		fn:          ShareAdd,
+		explanation: "Add a share",
+	},
+	Command{
+		cmd:         "sharememberadd",
+		fn:          ShareMemberAdd,
+		explanation: "Add a member to a share, or change their role",
+	},
+	Command{
+		cmd:         "sharememberdel",
+		fn:          ShareMemberDel,
+		explanation: "Remove a member from a share",
+	},
+	Command{
+		cmd:         "sharemembers",
+		fn:          ShareMembers,
+		explanation: "List the members of a share",
+	},
+	Command{
+		cmd:         "devices",
+		fn:          Devices,
+		explanation: "List a user's devices",
+	},
+	Command{
+		cmd:         "devicerevoke",
+		fn:          DeviceRevoke,
+		explanation: "Revoke one of a user's devices, changing their password",
+	},
+	Command{
+		cmd:         "compact",
+		fn:          Compact,
+		explanation: "Drop old events according to the retention policy",
+	},
+	Command{
+		cmd:         "droppedhashes",
+		fn:          DroppedHashes,
+		explanation: "List the hashes of files no longer needed since compaction",
+	},
 	Command{
 		cmd:         "version",
 		fn:          PrintVersion,
@@ -16,11 +16,12 @@ type UserModifier struct {
 }
 
 type UserModifierArgs struct {
-	Current        *User
-	Updated        *User
-	UpdateLogin    bool
-	UpdateRole     bool
-	UpdatePassword bool
+	Current              *User
+	Updated              *User
+	UpdateLogin          bool
+	UpdateRole           bool
+	UpdatePassword       bool
+	UpdateRequireDevices bool
 }
 
 func (u *UserModifier) AddUser(user *User, result *int) error {
@@ -49,6 +50,9 @@ func (u *UserModifier) ModifyUser(args *UserModifierArgs, result *int) error {
 	if args.UpdatePassword {
 		currentUser.PWHash = args.Updated.PWHash
 	}
+	if args.UpdateRequireDevices {
+		currentUser.RequireDevices = args.Updated.RequireDevices
+	}
 
 	err = u.adb.DatabaseUpdateUser(currentUser)
 	if err != nil {
@@ -70,6 +74,150 @@ func (u *UserModifier) RemoveUser(user *User, result *int) error {
 	return err
 }
 
+type ShareModifierArgs struct {
+	Owner  string //username of the share's owner
+	Share  string
+	Member string //username of the member being added, modified, or removed
+	Role   asink.ShareRole
+}
+
+//looks up the share args refers to, which must already exist
+func (u *UserModifier) getShare(args *ShareModifierArgs) (*Share, error) {
+	owner, err := u.adb.DatabaseGetUser(args.Owner)
+	if err != nil {
+		return nil, err
+	}
+	return u.adb.DatabaseGetOwnedShare(owner, args.Share)
+}
+
+func (u *UserModifier) AddShare(args *ShareModifierArgs, result *int) error {
+	owner, err := u.adb.DatabaseGetUser(args.Owner)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	_, err = u.adb.DatabaseAddShare(owner, args.Share)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	*result = 0
+	return nil
+}
+
+func (u *UserModifier) SetShareMember(args *ShareModifierArgs, result *int) error {
+	share, err := u.getShare(args)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	member, err := u.adb.DatabaseGetUser(args.Member)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	err = u.adb.DatabaseSetShareMember(share, member, args.Role)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	*result = 0
+	return nil
+}
+
+func (u *UserModifier) RemoveShareMember(args *ShareModifierArgs, result *int) error {
+	share, err := u.getShare(args)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	member, err := u.adb.DatabaseGetUser(args.Member)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	err = u.adb.DatabaseRemoveShareMember(share, member)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	*result = 0
+	return nil
+}
+
+func (u *UserModifier) GetShareMembers(args *ShareModifierArgs, result *[]*ShareMember) error {
+	share, err := u.getShare(args)
+	if err != nil {
+		return err
+	}
+	*result, err = u.adb.DatabaseGetShareMembers(share)
+	return err
+}
+
+type DeviceModifierArgs struct {
+	Username string
+	DeviceId int64
+	PWHash   string //the user's new password, which must be changed when revoking a device
+}
+
+func (u *UserModifier) GetDevices(args *DeviceModifierArgs, result *[]*Device) error {
+	user, err := u.adb.DatabaseGetUser(args.Username)
+	if err != nil {
+		return err
+	}
+	*result, err = u.adb.DatabaseGetDevices(user)
+	return err
+}
+
+func (u *UserModifier) RevokeDevice(args *DeviceModifierArgs, result *int) error {
+	user, err := u.adb.DatabaseGetUser(args.Username)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	if args.PWHash == "" || args.PWHash == user.PWHash {
+		*result = 1
+		return NewPasswordRequiredErr
+	}
+	err = u.adb.DatabaseRevokeDevice(user, args.DeviceId, args.PWHash)
+	if err != nil {
+		*result = 1
+		return err
+	}
+	*result = 0
+	return nil
+}
+
+type Compactor struct {
+	adb *AsinkDB
+}
+
+//compacts all shares now, according to the server's retention policy
+func (c *Compactor) Compact(args *int, result *int) error {
+	if !retention.Enabled() {
+		*result = 0
+		return RetentionDisabledErr
+	}
+	dropped, err := CompactAllShares(retention)
+	*result = dropped
+	return err
+}
+
+func (c *Compactor) GetDroppedHashes(args *int, result *[]string) (err error) {
+	*result, err = c.adb.DatabaseGetDroppedHashes()
+	return err
+}
+
+func (c *Compactor) ForgetDroppedHashes(hashes *[]string, result *int) error {
+	err := c.adb.DatabaseForgetDroppedHashes(*hashes)
+	if err != nil {
+		*result = 1
+	} else {
+		*result = 0
+	}
+	return err
+}
+
 type ServerStopper int
 
 func (s *ServerStopper) StopServer(code *int, result *int) error {
@@ -85,6 +233,10 @@ func StartRPC(sock string, tornDown chan int, adb *AsinkDB) {
 	usermod.adb = adb
 	rpc.Register(usermod)
 
+	compactor := new(Compactor)
+	compactor.adb = adb
+	rpc.Register(compactor)
+
 	serverstop := new(ServerStopper)
 	rpc.Register(serverstop)
 
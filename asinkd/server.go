@@ -5,27 +5,41 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/aclindsa/asink"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const EVENTS_PER_RESPONSE = 50              //number of events returned at once, unless the client asks for a different number
+const MAX_EVENTS_PER_RESPONSE = 1000        //the most events the client may ask for at once
+const LONG_POLL_TIMEOUT = 1 * time.Minute   //how long to wait for new events before returning none
+const HEARTBEAT_INTERVAL = 30 * time.Second //how often to let streaming clients know we're still here
+
 //global variables
 var eventsRegexp *regexp.Regexp
+var shareEventsRegexp *regexp.Regexp
+var shareStreamRegexp *regexp.Regexp
+var shareSnapshotRegexp *regexp.Regexp
 var port int = 8080
 var rpcSock string
 var adb *AsinkDB
 
 func init() {
 	eventsRegexp = regexp.MustCompile("^/events/([0-9]+)$")
+	shareEventsRegexp = regexp.MustCompile("^/shares/([^/]+)/events(?:/([0-9]*))?$")
+	shareStreamRegexp = regexp.MustCompile("^/shares/([^/]+)/stream$")
+	shareSnapshotRegexp = regexp.MustCompile("^/shares/([^/]+)/snapshot$")
 
 	asink.SetupCleanExitOnSignals()
 }
@@ -42,7 +56,13 @@ func StartServer(args []string) {
 	flags.IntVar(&port, "p", 8080, port_usage+" (shorthand)")
 	flags.StringVar(&rpcSock, "sock", sock_default, sock_usage)
 	flags.StringVar(&rpcSock, "s", sock_default, sock_usage+" (shorthand)")
+	flags.IntVar(&retention.KeepVersions, "keepversions", 0, "Number of versions of each file to keep when compacting events (0 keeps them all)")
+	keepDays := flags.Int("keepdays", 0, "Also keep all versions of files from this many days ago or later when compacting events")
+	tombstoneDays := flags.Int("tombstonedays", 0, "Number of days to remember deleted files when compacting events (0 remembers them forever)")
+	compactHours := flags.Int("compactinterval", 24, "Number of hours between compacting events, if -keepversions or -tombstonedays is set")
 	flags.Parse(args)
+	retention.KeepFor = time.Duration(*keepDays) * 24 * time.Hour
+	retention.TombstonesFor = time.Duration(*tombstoneDays) * 24 * time.Hour
 
 	adb, err = GetAndInitDB()
 	if err != nil {
@@ -51,10 +71,20 @@ func StartServer(args []string) {
 
 	rpcTornDown := make(chan int)
 	go StartRPC(rpcSock, rpcTornDown, adb)
+	go StartCompacting(time.Duration(*compactHours) * time.Hour)
 
+	//the unversioned endpoints are kept for older clients
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/events", eventHandler)
 	http.HandleFunc("/events/", eventHandler)
+	http.HandleFunc("/shares/", shareEventHandler)
+	for _, version := range asink.API_VERSIONS {
+		prefix := "/v" + strconv.Itoa(version)
+		http.Handle(prefix+"/events", http.StripPrefix(prefix, http.HandlerFunc(eventHandler)))
+		http.Handle(prefix+"/events/", http.StripPrefix(prefix, http.HandlerFunc(eventHandler)))
+		http.Handle(prefix+"/shares/", http.StripPrefix(prefix, http.HandlerFunc(shareEventHandler)))
+		http.Handle(prefix+"/devices", http.StripPrefix(prefix, http.HandlerFunc(deviceHandler)))
+	}
 
 	//TODO add HTTPS, something like http://golang.org/pkg/net/http/#ListenAndServeTLS
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -83,11 +113,99 @@ func StopServer(args []string) {
 	}
 }
 
+//Advertises the versions of the API we support
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "You're probably looking for /events/")
+	if r.URL.Path != "/" {
+		writeError(w, 404, "Not found - see / for the supported API versions")
+		return
+	}
+	versions := asink.APIVersions{
+		Versions:         asink.API_VERSIONS,
+		ServerVersion:    asink.VERSION_STRING,
+		ContentTypes:     asink.CONTENT_TYPES,
+		ContentEncodings: []string{asink.GZIP_ENCODING},
+	}
+	b, err := json.Marshal(versions)
+	if err != nil {
+		b = []byte(err.Error())
+	}
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, code int, explanation string) {
+	apiresponse := asink.APIResponse{
+		Status:      asink.ERROR,
+		Explanation: explanation,
+	}
+	b, err := json.Marshal(apiresponse)
+	if err != nil {
+		b = []byte(err.Error())
+	}
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+//Writes apiresponse in the content type and encoding the client asked for
+func writeResponse(w http.ResponseWriter, r *http.Request, code int, apiresponse asink.APIResponse) {
+	contentType := asink.NegotiateContentType(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", contentType)
+	var out io.Writer = w
+	if asink.AcceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", asink.GZIP_ENCODING)
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	w.WriteHeader(code)
+	err := asink.Encode(out, contentType, apiresponse)
+	if err != nil {
+		fmt.Println("Error encoding response: " + err.Error())
+	}
+}
+
+//Decodes the body of r, which may be compressed, into v
+func readRequest(r *http.Request, v interface{}) error {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == asink.GZIP_ENCODING {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return asink.Decode(body, r.Header.Get("Content-Type"), v)
+}
+
+//Returns the number of events the client asked to receive at once, within
+//reason
+func pageSize(r *http.Request) uint {
+	limit, err := strconv.ParseUint(r.URL.Query().Get("limit"), 10, 32)
+	if err != nil || limit == 0 {
+		return EVENTS_PER_RESPONSE
+	}
+	if limit > MAX_EVENTS_PER_RESPONSE {
+		return MAX_EVENTS_PER_RESPONSE
+	}
+	return uint(limit)
+}
+
+//Makes sure we support the version of the API the client says it is using,
+//if it says. Returns false (after responding with an error) if we don't.
+func checkAPIVersion(w http.ResponseWriter, r *http.Request) bool {
+	header := r.Header.Get(asink.API_VERSION_HEADER)
+	if header == "" {
+		return true
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil || !asink.SupportsAPIVersion(version) {
+		writeError(w, 400, "Unsupported API version '"+header+"' - see / for the supported API versions")
+		return false
+	}
+	return true
 }
 
-func getEvents(w http.ResponseWriter, r *http.Request, user *User, nextEvent uint64) {
+func getEvents(w http.ResponseWriter, r *http.Request, share *Share, nextEvent uint64) {
 	var events []*asink.Event
 	var error_message string = ""
 	defer func() {
@@ -96,22 +214,24 @@ func getEvents(w http.ResponseWriter, r *http.Request, user *User, nextEvent uin
 			apiresponse = asink.APIResponse{
 				Status:      asink.ERROR,
 				Explanation: error_message,
+				Role:        share.Role,
 			}
 		} else {
 			apiresponse = asink.APIResponse{
 				Status: asink.SUCCESS,
 				Events: events,
+				Role:   share.Role,
 			}
 		}
-		b, err := json.Marshal(apiresponse)
-		if err != nil {
-			error_message = err.Error()
-			return
-		}
-		w.Write(b)
+		writeResponse(w, r, 200, apiresponse)
 	}()
 
-	events, err := adb.DatabaseRetrieveEvents(nextEvent, 50, user)
+	//start listening before checking for events so none are missed
+	c := addPoller(share.Id)
+	defer removePoller(share.Id, c)
+
+	limit := pageSize(r)
+	events, err := adb.DatabaseRetrieveEvents(nextEvent, limit, share)
 	if err != nil {
 		error_message = err.Error()
 		return
@@ -119,89 +239,440 @@ func getEvents(w http.ResponseWriter, r *http.Request, user *User, nextEvent uin
 
 	//long-poll if events is empty
 	if len(events) == 0 {
-		c := make(chan *asink.Event)
-		addPoller(user.Id, &c) //TODO support more than one share per user
-		e, ok := <-c
-		if ok {
-			events = append(events, e)
+		select {
+		case <-c:
+			events, err = adb.DatabaseRetrieveEvents(nextEvent, limit, share)
+			if err != nil {
+				error_message = err.Error()
+				return
+			}
+		case <-time.After(LONG_POLL_TIMEOUT):
 		}
 	}
 }
 
-func putEvents(w http.ResponseWriter, r *http.Request, user *User) {
+//Streams events to the client, starting after the id in the Last-Event-ID
+//header (if any). By default, they are sent as Server-Sent Events: each
+//message's data is an APIResponse holding one or more events, and its id is
+//the id of the last of them, and comments are sent as heartbeats when there
+//are no new events. Clients which accept gob are instead sent a stream of
+//gob-encoded APIResponses, with empty ones as heartbeats. Either may be
+//gzipped.
+func streamEvents(w http.ResponseWriter, r *http.Request, share *Share) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming is not supported")
+		return
+	}
+
+	var nextEvent uint64 = 0
+	if lastId := r.Header.Get("Last-Event-ID"); lastId != "" {
+		i, err := strconv.ParseUint(lastId, 10, 64)
+		if err != nil {
+			writeError(w, 400, "Invalid Last-Event-ID: "+lastId)
+			return
+		}
+		nextEvent = i + 1
+	}
+	limit := pageSize(r)
+
+	//start listening before checking for events so none are missed
+	c := addPoller(share.Id)
+	defer removePoller(share.Id, c)
+
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if asink.AcceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", asink.GZIP_ENCODING)
+		gz = gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	flush := func() error {
+		if gz != nil {
+			err := gz.Flush()
+			if err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	var send func(id string, apiresponse asink.APIResponse) error
+	var sendHeartbeat func() error
+	if asink.NegotiateContentType(r.Header.Get("Accept")) == asink.GOB_CONTENT_TYPE {
+		w.Header().Set("Content-Type", asink.GOB_CONTENT_TYPE)
+		encoder := gob.NewEncoder(out)
+		send = func(id string, apiresponse asink.APIResponse) error {
+			return encoder.Encode(apiresponse)
+		}
+		sendHeartbeat = func() error {
+			return encoder.Encode(asink.APIResponse{Status: asink.SUCCESS, Role: share.Role})
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		send = func(id string, apiresponse asink.APIResponse) error {
+			return writeServerSentEvent(out, id, apiresponse)
+		}
+		sendHeartbeat = func() error {
+			_, err := io.WriteString(out, ": heartbeat\n\n")
+			return err
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	//let the client know its role in the share before there are any events
+	err := send("", asink.APIResponse{Status: asink.SUCCESS, Role: share.Role})
+	if err != nil {
+		return
+	}
+	if flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		//send everything we haven't already
+		for {
+			events, err := adb.DatabaseRetrieveEvents(nextEvent, limit, share)
+			if err != nil {
+				send("", asink.APIResponse{Status: asink.ERROR, Explanation: err.Error(), Role: share.Role})
+				return
+			}
+			if len(events) == 0 {
+				break
+			}
+			lastId := events[len(events)-1].Id
+			err = send(strconv.FormatInt(lastId, 10), asink.APIResponse{Status: asink.SUCCESS, Events: events, Role: share.Role})
+			if err != nil {
+				return
+			}
+			nextEvent = uint64(lastId) + 1
+		}
+		if flush() != nil {
+			return
+		}
+
+		select {
+		case <-c:
+		case <-heartbeat.C:
+			//this is also how we notice the client has gone away
+			if sendHeartbeat() != nil || flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+//Returns a page of the latest events for each path in the share, as of the
+//event id in the 'asof' query parameter (or its latest event). The page
+//starts with the first path sorting after the 'after' query parameter, and
+//the id the snapshot was taken as of is returned, so clients can ask for the
+//rest of the same snapshot and then continue with the events after it.
+func getSnapshot(w http.ResponseWriter, r *http.Request, share *Share) {
+	var asOf int64
+	if s := r.URL.Query().Get("asof"); s != "" {
+		var err error
+		asOf, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(w, 400, "Invalid snapshot event id: "+s)
+			return
+		}
+	}
+
+	snapshot, err := snapshotOf(share, asOf)
+	if err != nil {
+		writeResponse(w, r, 200, asink.APIResponse{
+			Status:      asink.ERROR,
+			Explanation: err.Error(),
+			Role:        share.Role,
+		})
+		return
+	}
+
+	writeResponse(w, r, 200, asink.APIResponse{
+		Status: asink.SUCCESS,
+		Events: snapshot.page(r.URL.Query().Get("after"), pageSize(r)),
+		Role:   share.Role,
+		AsOf:   snapshot.asOf,
+	})
+}
+
+func writeServerSentEvent(w io.Writer, id string, apiresponse asink.APIResponse) error {
+	b, err := json.Marshal(apiresponse)
+	if err != nil {
+		return err
+	}
+	message := ""
+	if id != "" {
+		message = "id: " + id + "\n"
+	}
+	_, err = io.WriteString(w, message+"data: "+string(b)+"\n\n")
+	return err
+}
+
+//Returns why event can't be accepted, or "" if it can
+func invalidEvent(event *asink.Event) string {
+	if event.IsUpdate() == event.IsDelete() {
+		return "Events must either update or delete a path"
+	}
+	if event.Path == "" || strings.HasPrefix(event.Path, "/") {
+		return "Invalid path: '" + event.Path + "'"
+	}
+	for _, element := range strings.Split(event.Path, "/") {
+		if element == ".." {
+			return "Invalid path: '" + event.Path + "'"
+		}
+	}
+	if event.IsMove() && (!event.IsUpdate() || event.SourcePath == "") {
+		return "Moves must update the path moved to, and include the path moved from"
+	}
+	return ""
+}
+
+func putEvents(w http.ResponseWriter, r *http.Request, user *User, device *Device, share *Share) {
 	var events asink.EventList
+	var results []*asink.EventResult
 	var error_message string = ""
+	code := 200
 	defer func() {
 		var apiresponse asink.APIResponse
 		if error_message != "" {
 			apiresponse = asink.APIResponse{
 				Status:      asink.ERROR,
 				Explanation: error_message,
+				Role:        share.Role,
 			}
 		} else {
 			apiresponse = asink.APIResponse{
-				Status: asink.SUCCESS,
+				Status:  asink.SUCCESS,
+				Role:    share.Role,
+				Results: results,
 			}
 		}
-		b, err := json.Marshal(apiresponse)
-		if err != nil {
-			error_message = err.Error()
-			return
-		}
-		w.Write(b)
+		writeResponse(w, r, code, apiresponse)
 	}()
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		error_message = err.Error()
+	if !share.Role.CanWrite() {
+		code = 403
+		error_message = "You have " + share.Role.String() + " access to share '" + share.Name + "'"
 		return
 	}
-	err = json.Unmarshal(body, &events)
+
+	err := readRequest(r, &events)
 	if err != nil {
 		error_message = err.Error()
 		return
 	}
-	err = adb.DatabaseAddEvents(user, events.Events)
-	if err != nil {
-		error_message = err.Error()
-		return
+
+	//one invalid event shouldn't prevent the rest from being added
+	var valid []*asink.Event
+	for _, event := range events.Events {
+		result := new(asink.EventResult)
+		if explanation := invalidEvent(event); explanation != "" {
+			result.Status = asink.ERROR
+			result.Explanation = explanation
+		} else {
+			result.Status = asink.SUCCESS
+			valid = append(valid, event)
+		}
+		results = append(results, result)
+	}
+
+	var conflicts []*asink.Event
+	if len(valid) > 0 {
+		conflicts, err = adb.DatabaseAddEvents(user, device, share, valid)
+		if err != nil {
+			results = nil
+			error_message = err.Error()
+			return
+		}
+		broadcastToPollers(share.Id)
 	}
 
-	broadcastToPollers(user.Id, events.Events[0])
+	for i, event := range events.Events {
+		if results[i].Status != asink.SUCCESS {
+			continue
+		}
+		if conflicts[0] != nil {
+			results[i].Status = asink.CONFLICT
+			results[i].Explanation = "'" + event.Path + "' has been changed since the version this event was made from"
+			results[i].Head = conflicts[0]
+		} else {
+			results[i].Id = event.Id
+		}
+		conflicts = conflicts[1:]
+	}
 }
 
+//The /events/ endpoints operate on the user's default share
 func eventHandler(w http.ResponseWriter, r *http.Request) {
+	nextEvent := ""
+	if sm := eventsRegexp.FindStringSubmatch(r.URL.Path); sm != nil {
+		nextEvent = sm[1]
+	}
+	handleEvents(w, r, asink.DEFAULT_SHARE, nextEvent)
+}
+
+func shareEventHandler(w http.ResponseWriter, r *http.Request) {
+	if sm := shareStreamRegexp.FindStringSubmatch(r.URL.Path); sm != nil {
+		if r.Method != "GET" {
+			writeError(w, 405, "Invalid HTTP method - only GET is supported on this endpoint.")
+			return
+		}
+		_, _, share := authenticateShare(w, r, sm[1])
+		if share != nil {
+			streamEvents(w, r, share)
+		}
+		return
+	}
+	if sm := shareSnapshotRegexp.FindStringSubmatch(r.URL.Path); sm != nil {
+		if r.Method != "GET" {
+			writeError(w, 405, "Invalid HTTP method - only GET is supported on this endpoint.")
+			return
+		}
+		_, _, share := authenticateShare(w, r, sm[1])
+		if share != nil {
+			getSnapshot(w, r, share)
+		}
+		return
+	}
+	sm := shareEventsRegexp.FindStringSubmatch(r.URL.Path)
+	if sm == nil {
+		writeError(w, 404, "Not found - try /shares/<name>/events/")
+		return
+	}
+	handleEvents(w, r, sm[1], sm[2])
+}
+
+//Authenticates the user and the device they are using (if any), and looks up
+//the share they asked for. If any of these fail, an error is written to w,
+//and nil is returned for the share.
+func authenticateShare(w http.ResponseWriter, r *http.Request, shareName string) (*User, *Device, *Share) {
+	if !checkAPIVersion(w, r) {
+		return nil, nil, nil
+	}
 	user := AuthenticateUser(r)
 	if user == nil {
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"Asink Server\"")
-		apiresponse := asink.APIResponse{
-			Status:      asink.ERROR,
-			Explanation: "This operation requires user authentication",
-		}
-		b, err := json.Marshal(apiresponse)
-		if err != nil {
-			b = []byte(err.Error())
+		writeError(w, 401, "This operation requires user authentication")
+		return nil, nil, nil
+	}
+	device, ok := authenticateDevice(w, r, user)
+	if !ok {
+		return nil, nil, nil
+	}
+	share, err := adb.DatabaseGetShare(user, shareName)
+	if err == InvalidShareNameErr {
+		writeError(w, 400, err.Error())
+		return nil, nil, nil
+	} else if err != nil {
+		writeError(w, 500, err.Error())
+		return nil, nil, nil
+	}
+	return user, device, share
+}
+
+//Returns the device the request says it came from, or nil if it doesn't say
+//(i.e. because the client is older than device registration). If the device
+//can't be authenticated or has been revoked, or the request doesn't say which
+//device it came from and the user has chosen to require that, an error is
+//written to w and false is returned.
+func authenticateDevice(w http.ResponseWriter, r *http.Request, user *User) (*Device, bool) {
+	deviceId := r.Header.Get(asink.DEVICE_HEADER)
+	if deviceId == "" {
+		if user.RequireDevices {
+			writeError(w, 401, "This operation requires device credentials")
+			return nil, false
 		}
-		w.WriteHeader(401)
-		w.Write(b)
+		return nil, true
+	}
+	id, err := strconv.ParseInt(deviceId, 10, 64)
+	if err != nil {
+		writeError(w, 401, "Invalid device id: "+deviceId)
+		return nil, false
+	}
+	device, err := adb.DatabaseGetDevice(user, id)
+	if err == NoDeviceErr || (err == nil && !device.ValidToken(r.Header.Get(asink.DEVICE_TOKEN_HEADER))) {
+		writeError(w, 401, "Invalid device credentials")
+		return nil, false
+	} else if err != nil {
+		writeError(w, 500, err.Error())
+		return nil, false
+	}
+	if device.Revoked {
+		writeResponse(w, r, 403, asink.APIResponse{
+			Status:      asink.REVOKED,
+			Explanation: "Device '" + device.Name + "' has been revoked",
+		})
+		return nil, false
+	}
+	return device, true
+}
+
+//Registers a new device for the authenticated user
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, 405, "Invalid HTTP method - only POST is supported on this endpoint.")
+		return
+	}
+	if !checkAPIVersion(w, r) {
+		return
+	}
+	user := AuthenticateUser(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"Asink Server\"")
+		writeError(w, 401, "This operation requires user authentication")
+		return
+	}
+
+	var request asink.Device
+	err := readRequest(r, &request)
+	if err != nil {
+		writeError(w, 400, err.Error())
 		return
 	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		writeError(w, 400, "Devices must have a name")
+		return
+	}
+
+	device, token, err := adb.DatabaseAddDevice(user, name)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	writeResponse(w, r, 200, asink.APIResponse{
+		Status: asink.SUCCESS,
+		Device: &asink.Device{Id: device.Id, Name: device.Name, Token: token},
+	})
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request, shareName, nextEvent string) {
+	user, device, share := authenticateShare(w, r, shareName)
+	if share == nil {
+		return
+	}
+
 	if r.Method == "GET" {
 		//if GET, return any events later than (and including) the event id passed in
-		if sm := eventsRegexp.FindStringSubmatch(r.RequestURI); sm != nil {
-			i, err := strconv.ParseUint(sm[1], 10, 64)
+		if nextEvent != "" {
+			i, err := strconv.ParseUint(nextEvent, 10, 64)
 			if err != nil {
 				//TODO display error message here instead
-				fmt.Printf("ERROR parsing " + sm[1] + "\n")
-				getEvents(w, r, user, 0)
+				fmt.Printf("ERROR parsing " + nextEvent + "\n")
+				getEvents(w, r, share, 0)
 			} else {
-				getEvents(w, r, user, i)
+				getEvents(w, r, share, i)
 			}
 		} else {
-			getEvents(w, r, user, 0)
+			getEvents(w, r, share, 0)
 		}
 	} else if r.Method == "POST" {
-		putEvents(w, r, user)
+		putEvents(w, r, user, device, share)
 	} else {
 		apiresponse := asink.APIResponse{
 			Status:      asink.ERROR,
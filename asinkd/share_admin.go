@@ -0,0 +1,114 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/aclindsa/asink"
+	"net/rpc"
+	"os"
+)
+
+//errors which are the user's fault, and shouldn't cause a panic
+var shareAdminErrs = []error{NoUserErr, NoShareErr, NoShareMemberErr, DuplicateShareErr, InvalidShareNameErr, ShareOwnerErr}
+
+func shareRPCCall(rpcSocket, method string, args *ShareModifierArgs, reply interface{}) {
+	err := asink.RPCCall(rpcSocket, method, args, reply)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			for _, e := range shareAdminErrs {
+				if err.Error() == e.Error() {
+					fmt.Println("Error: " + err.Error())
+					os.Exit(1)
+				}
+			}
+		}
+		panic(err)
+	}
+}
+
+func ShareAdd(args []string) {
+	flags := flag.NewFlagSet("shareadd", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println("Error: please supply the owner's username and the name of the share")
+		os.Exit(1)
+	}
+
+	rpcargs := new(ShareModifierArgs)
+	rpcargs.Owner = flags.Arg(0)
+	rpcargs.Share = flags.Arg(1)
+
+	i := 99
+	shareRPCCall(*rpcSocket, "UserModifier.AddShare", rpcargs, &i)
+}
+
+func ShareMemberAdd(args []string) {
+	flags := flag.NewFlagSet("sharememberadd", flag.ExitOnError)
+	readonly := flags.Bool("readonly", false, "Member may only read the share, not change it")
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		fmt.Println("Error: please supply the owner's username, the name of the share, and the username of the member")
+		os.Exit(1)
+	}
+
+	rpcargs := new(ShareModifierArgs)
+	rpcargs.Owner = flags.Arg(0)
+	rpcargs.Share = flags.Arg(1)
+	rpcargs.Member = flags.Arg(2)
+	if *readonly {
+		rpcargs.Role = asink.READONLY
+	} else {
+		rpcargs.Role = asink.READWRITE
+	}
+
+	i := 99
+	shareRPCCall(*rpcSocket, "UserModifier.SetShareMember", rpcargs, &i)
+}
+
+func ShareMemberDel(args []string) {
+	flags := flag.NewFlagSet("sharememberdel", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		fmt.Println("Error: please supply the owner's username, the name of the share, and the username of the member")
+		os.Exit(1)
+	}
+
+	rpcargs := new(ShareModifierArgs)
+	rpcargs.Owner = flags.Arg(0)
+	rpcargs.Share = flags.Arg(1)
+	rpcargs.Member = flags.Arg(2)
+
+	i := 99
+	shareRPCCall(*rpcSocket, "UserModifier.RemoveShareMember", rpcargs, &i)
+}
+
+func ShareMembers(args []string) {
+	flags := flag.NewFlagSet("sharemembers", flag.ExitOnError)
+	rpcSocket := flags.String("sock", rpcSocketDefault, rpcSocketDescription)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println("Error: please supply the owner's username and the name of the share")
+		os.Exit(1)
+	}
+
+	rpcargs := new(ShareModifierArgs)
+	rpcargs.Owner = flags.Arg(0)
+	rpcargs.Share = flags.Arg(1)
+
+	var members []*ShareMember
+	shareRPCCall(*rpcSocket, "UserModifier.GetShareMembers", rpcargs, &members)
+	for _, member := range members {
+		fmt.Printf("%s\t%s\n", member.Username, member.Role)
+	}
+}
@@ -0,0 +1,26 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+)
+
+//A share is an independent collection of synchronized files, with its own
+//sequence of event ids. Users may have any number of shares, which are
+//created the first time they are used, and may add other users to them as
+//members. Each user refers to the shares they belong to by name, so no user
+//may belong to two shares with the same name.
+type Share struct {
+	Id     int64
+	UserId int64 //the user who owns this share
+	Name   string
+	Role   asink.ShareRole //the role of the user this share was retrieved for
+}
+
+type ShareMember struct {
+	Username string
+	Role     asink.ShareRole
+}
@@ -0,0 +1,205 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//The state of a share as of one of its events: the latest event for each
+//file, directory, or symlink which existed at that point. This allows new
+//clients to start with the current version of each file rather than
+//replaying the share's whole history.
+type Snapshot struct {
+	asOf  int64
+	files map[string]*asink.Event //keyed by path
+	paths []string                //the keys of files, sorted
+}
+
+//how many snapshots are kept, so clients paging through snapshots taken as of
+//different events don't keep causing each other's to be rebuilt
+const MAX_CACHED_SNAPSHOTS = 8
+
+type snapshotKey struct {
+	share int64
+	asOf  int64
+}
+
+//Keeps the snapshots which have been asked for most recently, so a client
+//paging through one doesn't cause it to be rebuilt for each page, and later
+//snapshots only need to apply the events added since an earlier one.
+type SnapshotManager struct {
+	lock      sync.Mutex
+	snapshots map[snapshotKey]*Snapshot
+	recent    []snapshotKey //least recently used first
+}
+
+var sm *SnapshotManager
+
+func init() {
+	sm = new(SnapshotManager)
+	sm.snapshots = make(map[snapshotKey]*Snapshot)
+}
+
+//Returns the cached snapshot of share as of asOf, or the latest one before
+//it (which is false) if it isn't cached, or nil if neither is
+func (m *SnapshotManager) get(share int64, asOf int64) (*Snapshot, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := snapshotKey{share, asOf}
+	if snapshot, ok := m.snapshots[key]; ok {
+		m.use(key)
+		return snapshot, true
+	}
+	var earlier *Snapshot
+	for key, snapshot := range m.snapshots {
+		if key.share == share && key.asOf < asOf && (earlier == nil || key.asOf > earlier.asOf) {
+			earlier = snapshot
+		}
+	}
+	return earlier, false
+}
+
+//Caches snapshot, forgetting the least recently used if there are too many
+func (m *SnapshotManager) add(share int64, snapshot *Snapshot) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := snapshotKey{share, snapshot.asOf}
+	m.snapshots[key] = snapshot
+	m.use(key)
+	for len(m.recent) > MAX_CACHED_SNAPSHOTS {
+		delete(m.snapshots, m.recent[0])
+		m.recent = m.recent[1:]
+	}
+}
+
+//marks key as the most recently used. The lock must already be held.
+func (m *SnapshotManager) use(key snapshotKey) {
+	for i, k := range m.recent {
+		if k == key {
+			m.recent = append(m.recent[:i], m.recent[i+1:]...)
+			break
+		}
+	}
+	m.recent = append(m.recent, key)
+}
+
+//Returns the snapshot of share as of the event with id asOf, or as of its
+//latest event if asOf is 0 or later than that.
+func snapshotOf(share *Share, asOf int64) (*Snapshot, error) {
+	latestId, err := adb.DatabaseLatestEventId(share)
+	if err != nil {
+		return nil, err
+	}
+	if asOf <= 0 || asOf > latestId {
+		asOf = latestId
+	}
+
+	cached, ok := sm.get(share.Id, asOf)
+	if ok {
+		return cached, nil
+	}
+
+	//start from the latest cached snapshot older than the one we need
+	snapshot := &Snapshot{files: make(map[string]*asink.Event)}
+	if cached != nil {
+		snapshot.asOf = cached.asOf
+		for path, event := range cached.files {
+			snapshot.files[path] = event
+		}
+	}
+
+	for next := snapshot.asOf + 1; next <= asOf; {
+		events, err := adb.DatabaseRetrieveEvents(uint64(next), MAX_EVENTS_PER_RESPONSE, share)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if event.Id > asOf {
+				break
+			}
+			snapshot.apply(event)
+		}
+		next = events[len(events)-1].Id + 1
+	}
+	snapshot.asOf = asOf
+
+	for path := range snapshot.files {
+		snapshot.paths = append(snapshot.paths, path)
+	}
+	sort.Strings(snapshot.paths)
+
+	sm.add(share.Id, snapshot)
+	return snapshot, nil
+}
+
+//Updates the snapshot to reflect event. Events already in the snapshot are
+//never modified, since older snapshots may still be sharing them.
+func (s *Snapshot) apply(event *asink.Event) {
+	if event.IsMove() {
+		delete(s.files, event.SourcePath)
+		if event.IsDirectory() {
+			//the directory's contents moved along with it
+			prefix := event.SourcePath + "/"
+			for path, child := range s.files {
+				if !strings.HasPrefix(path, prefix) {
+					continue
+				}
+				//keep the id of the event which made its version
+				moved := *child
+				moved.Path = event.Path + "/" + strings.TrimPrefix(path, prefix)
+				if moved.Timestamp < event.Timestamp {
+					moved.Timestamp = event.Timestamp
+				}
+				if moved.Clock < event.Clock {
+					moved.Clock = event.Clock
+				}
+				delete(s.files, path)
+				s.files[moved.Path] = &moved
+			}
+		}
+	}
+
+	if event.IsUpdate() {
+		//clients receiving a snapshot have nothing to move
+		current := *event
+		current.Type &^= asink.MOVE
+		current.SourcePath = ""
+		s.files[event.Path] = &current
+	} else if event.IsDelete() {
+		delete(s.files, event.Path)
+		if event.IsDirectory() {
+			prefix := event.Path + "/"
+			for path := range s.files {
+				if strings.HasPrefix(path, prefix) {
+					delete(s.files, path)
+				}
+			}
+		}
+	}
+}
+
+//Returns up to limit events from the snapshot, in order of their paths,
+//starting with the first path which sorts after 'after'.
+func (s *Snapshot) page(after string, limit uint) []*asink.Event {
+	i := sort.SearchStrings(s.paths, after)
+	if i < len(s.paths) && s.paths[i] == after {
+		i++
+	}
+
+	events := []*asink.Event{}
+	for ; i < len(s.paths) && uint(len(events)) < limit; i++ {
+		events = append(events, s.files[s.paths[i]])
+	}
+	return events
+}
@@ -0,0 +1,74 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package main
+
+import (
+	"github.com/aclindsa/asink"
+	"testing"
+)
+
+func TestSnapshotManager(t *testing.T) {
+	m := &SnapshotManager{snapshots: make(map[snapshotKey]*Snapshot)}
+	newSnapshot := func(asOf int64) *Snapshot {
+		return &Snapshot{asOf: asOf, files: make(map[string]*asink.Event)}
+	}
+
+	m.add(1, newSnapshot(10))
+	m.add(1, newSnapshot(20))
+	m.add(2, newSnapshot(15))
+
+	if s, ok := m.get(1, 10); !ok || s.asOf != 10 {
+		t.Errorf("expected the snapshot of share 1 as of 10, got %v (%v)", s, ok)
+	}
+	if s, ok := m.get(1, 30); ok || s == nil || s.asOf != 20 {
+		t.Errorf("expected to start from the snapshot of share 1 as of 20, got %v (%v)", s, ok)
+	}
+	if s, ok := m.get(1, 15); ok || s == nil || s.asOf != 10 {
+		t.Errorf("expected to start from the snapshot of share 1 as of 10, got %v (%v)", s, ok)
+	}
+	if s, ok := m.get(2, 10); ok || s != nil {
+		t.Errorf("expected no snapshot of share 2 before 10, got %v (%v)", s, ok)
+	}
+
+	//the snapshot of share 1 as of 10 was used most recently, so it should
+	//outlast the others
+	m.get(1, 10)
+	for i := int64(0); i < MAX_CACHED_SNAPSHOTS-1; i++ {
+		m.add(3, newSnapshot(100+i))
+	}
+	if _, ok := m.get(1, 10); !ok {
+		t.Error("the most recently used snapshot was forgotten")
+	}
+	if _, ok := m.get(1, 20); ok {
+		t.Error("the least recently used snapshot wasn't forgotten")
+	}
+	if len(m.snapshots) != MAX_CACHED_SNAPSHOTS || len(m.recent) != MAX_CACHED_SNAPSHOTS {
+		t.Errorf("%d snapshots cached, expected %d", len(m.snapshots), MAX_CACHED_SNAPSHOTS)
+	}
+}
+
+func TestSnapshotApplyDirectoryMove(t *testing.T) {
+	s := &Snapshot{files: make(map[string]*asink.Event)}
+	s.apply(&asink.Event{Id: 1, Type: asink.UPDATE | asink.DIRECTORY, Path: "d", Timestamp: 1, Clock: 1})
+	s.apply(&asink.Event{Id: 2, Type: asink.UPDATE, Path: "d/f", Hash: "f", Timestamp: 2, Clock: 2})
+	s.apply(&asink.Event{Id: 3, Type: asink.UPDATE | asink.MOVE | asink.DIRECTORY, Path: "e", SourcePath: "d", Timestamp: 3, Clock: 3})
+
+	if len(s.files) != 2 || s.files["d"] != nil || s.files["d/f"] != nil {
+		t.Fatalf("expected only e and e/f in the snapshot, got %v", s.files)
+	}
+	moved := s.files["e/f"]
+	if moved == nil {
+		t.Fatal("e/f is missing from the snapshot")
+	}
+	if moved.Id != 2 || moved.Hash != "f" {
+		t.Errorf("e/f has id %d and hash %q, expected 2 and \"f\"", moved.Id, moved.Hash)
+	}
+	if moved.Clock != 3 || moved.Timestamp != 3 {
+		t.Errorf("e/f has clock %d and timestamp %d, expected it to be ordered after the move", moved.Clock, moved.Timestamp)
+	}
+	if dir := s.files["e"]; dir == nil || dir.Id != 3 || dir.IsMove() || dir.SourcePath != "" {
+		t.Errorf("e should be a plain directory with the move's id, got %+v", dir)
+	}
+}
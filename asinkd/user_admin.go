@@ -115,9 +115,11 @@ func UserMod(args []string) {
 	rpcargs.Updated = new(User)
 
 	admin := newBoolIsSetFlag(false)
+	requireDevices := newBoolIsSetFlag(false)
 
 	flags := flag.NewFlagSet("usermod", flag.ExitOnError)
 	flags.Var(admin, "admin", "User should be an administrator")
+	flags.Var(requireDevices, "requiredevices", "Only accept requests from the user's registered devices (once all their clients have registered)")
 	flags.BoolVar(&rpcargs.UpdatePassword, "password", false, "Change the user's password")
 	flags.BoolVar(&rpcargs.UpdatePassword, "p", false, "Change the user's password (short version)")
 	flags.BoolVar(&rpcargs.UpdateLogin, "login", false, "Change the user's username")
@@ -161,7 +163,10 @@ func UserMod(args []string) {
 		rpcargs.Updated.Role = NORMAL
 	}
 
-	if !rpcargs.UpdateRole && !rpcargs.UpdateLogin && !rpcargs.UpdatePassword {
+	rpcargs.UpdateRequireDevices = requireDevices.IsSet
+	rpcargs.Updated.RequireDevices = requireDevices.Value
+
+	if !rpcargs.UpdateRole && !rpcargs.UpdateLogin && !rpcargs.UpdatePassword && !rpcargs.UpdateRequireDevices {
 		fmt.Println("What exactly are you modifying again?")
 		return
 	}
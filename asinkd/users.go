@@ -18,10 +18,11 @@ const (
 )
 
 type User struct {
-	Id       int64
-	Username string
-	PWHash   string
-	Role     UserRole
+	Id             int64
+	Username       string
+	PWHash         string
+	Role           UserRole
+	RequireDevices bool //only accept requests from the user's registered devices
 }
 
 func HashPassword(pw string) string {
@@ -0,0 +1,71 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package asink
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+const (
+	JSON_CONTENT_TYPE = "application/json"
+	GOB_CONTENT_TYPE  = "application/x-gob" //more compact than JSON, but only understood by Go
+	GZIP_ENCODING     = "gzip"
+)
+
+//The content types which can be used to encode API requests and responses,
+//most preferred first. The content type used for a response is negotiated
+//with the Accept header, and defaults to JSON.
+var CONTENT_TYPES = []string{GOB_CONTENT_TYPE, JSON_CONTENT_TYPE}
+
+//Encodes v (an APIResponse or EventList) to w as contentType
+func Encode(w io.Writer, contentType string, v interface{}) error {
+	if mediaType(contentType) == GOB_CONTENT_TYPE {
+		return gob.NewEncoder(w).Encode(v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+//Decodes v (an APIResponse or EventList) from r, which is encoded as
+//contentType
+func Decode(r io.Reader, contentType string, v interface{}) error {
+	if mediaType(contentType) == GOB_CONTENT_TYPE {
+		return gob.NewDecoder(r).Decode(v)
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+//Returns the most preferred of CONTENT_TYPES listed in accept (the value of
+//an Accept header), or JSON if none are
+func NegotiateContentType(accept string) string {
+	for _, contentType := range CONTENT_TYPES {
+		if headerListContains(accept, contentType) {
+			return contentType
+		}
+	}
+	return JSON_CONTENT_TYPE
+}
+
+//Returns true if acceptEncoding (the value of an Accept-Encoding header)
+//allows responses to be gzipped
+func AcceptsGzip(acceptEncoding string) bool {
+	return headerListContains(acceptEncoding, GZIP_ENCODING)
+}
+
+//strips any parameters (i.e. "; charset=utf-8") from a content type
+func mediaType(contentType string) string {
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+func headerListContains(header, value string) bool {
+	for _, item := range strings.Split(header, ",") {
+		if mediaType(item) == value {
+			return true
+		}
+	}
+	return false
+}
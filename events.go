@@ -14,6 +14,9 @@ type EventType uint32
 const (
 	UPDATE = 1 << iota
 	DELETE
+	DIRECTORY //combined with UPDATE or DELETE for events which apply to a directory rather than a file
+	MOVE      //combined with UPDATE for events which move SourcePath to Path
+	SYMLINK   //combined with UPDATE or DELETE for events which apply to a symbolic link pointing to LinkTarget
 )
 
 //event status
@@ -23,6 +26,8 @@ const (
 	//Local event status flags
 	DISCARDED = EventStatus(1) << iota //event is to be discarded because it errored or is duplicate
 	NOSAVE                             //event should not be saved (only current reason is because its in the top half of local processing)
+	SKIPPED                            //event is tracked, but was not applied locally because its path isn't selected for synchronization
+	SENT                               //event was sent to the server, which assigned its Id, but hasn't come back from it yet
 )
 
 type Event struct {
@@ -31,10 +36,17 @@ type Event struct {
 	Path        string
 	Hash        string
 	Predecessor string
-	Timestamp   int64
+	Timestamp   int64 //when the event happened, in nanoseconds since the epoch
+	Clock       int64 //hybrid logical clock reading, used to order events
 	Permissions os.FileMode
+	SourcePath  string //the path moved from, for MOVE events
+	LinkTarget  string //where the link points, for SYMLINK events
+	MTime       int64  //modification time, in nanoseconds since the epoch
+	Xattrs      string //user.* extended attributes, as a JSON object of base64-encoded values
+	UUID        string //generated by the client which sent the event, so the server can tell if it is sent again
 	Username    string
-	Sharename   string      //TODO start differentiating between a users' different shares
+	Sharename   string      //the share this event belongs to, filled in by the server
+	Device      string      //the name of the device the event came from, filled in by the server
 	LocalStatus EventStatus `json:"-"`
 	LocalId     int64       `json:"-"`
 	InDB        bool        `json:"-"` //defaults to false. Omitted from json marshalling.
@@ -48,6 +60,32 @@ func (e *Event) IsDelete() bool {
 	return e.Type&DELETE == DELETE
 }
 
+func (e *Event) IsDirectory() bool {
+	return e.Type&DIRECTORY == DIRECTORY
+}
+
+func (e *Event) IsMove() bool {
+	return e.Type&MOVE == MOVE
+}
+
+func (e *Event) IsSymlink() bool {
+	return e.Type&SYMLINK == SYMLINK
+}
+
 func (e *Event) IsSameEvent(e2 *Event) bool {
-	return (e.Type == e2.Type && e.Path == e2.Path && e.Hash == e2.Hash && e.Predecessor == e2.Predecessor && e.Timestamp == e2.Timestamp && e.Permissions == e2.Permissions)
+	return (e.Type == e2.Type && e.Path == e2.Path && e.Hash == e2.Hash && e.Predecessor == e2.Predecessor && e.Timestamp == e2.Timestamp && e.Clock == e2.Clock && e.Permissions == e2.Permissions && e.SourcePath == e2.SourcePath && e.LinkTarget == e2.LinkTarget && e.MTime == e2.MTime && e.Xattrs == e2.Xattrs)
+}
+
+//Returns true if e happened before e2. Events are ordered by their clocks,
+//which respect the order in which machines saw each other's changes even if
+//their wall clocks disagree, and then by the order the server received them
+//in. Events the server hasn't received yet come after those it has.
+func (e *Event) Before(e2 *Event) bool {
+	if e.Clock != e2.Clock {
+		return e.Clock < e2.Clock
+	}
+	if e.Id == 0 || e2.Id == 0 {
+		return e.Id != 0 && e2.Id == 0
+	}
+	return e.Id < e2.Id
 }
@@ -7,17 +7,19 @@ package asink
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 )
 
 var exitWaiterCount int32
 var exitCalled chan int
 var exitWaiterChan chan int
+var exitOnce sync.Once
 
 func init() {
 	exitWaiterCount = 0
 	exitWaiterChan = make(chan int)
-	exitCalled = make(chan int)
+	exitCalled = make(chan int, 1)
 }
 
 func SetupCleanExitOnSignals() {
@@ -40,8 +42,10 @@ func setupCleanExitOnSignals() {
 	}
 }
 
+//Starts exiting with exitCode. Only the first call has any effect, and none
+//block, even if we are already exiting because of a signal.
 func Exit(exitCode int) {
-	exitCalled <- exitCode
+	exitOnce.Do(func() { exitCalled <- exitCode })
 }
 
 func WaitOnExit() int {
@@ -0,0 +1,42 @@
+/*
+ Copyright (C) 2013 Aaron Lindsay <aaron@aclindsay.com>
+*/
+
+package util
+
+import (
+	"database/sql"
+)
+
+//Adds a column to an existing table if it isn't already there, allowing
+//databases created by older versions to be upgraded in place. 'definition'
+//should include a default value (i.e. "TEXT NOT NULL DEFAULT ''") so that
+//existing rows remain valid.
+func EnsureColumnExists(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ");")
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue interface{}
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+
+	if found {
+		return nil
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition + ";")
+	return err
+}
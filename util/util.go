@@ -5,6 +5,8 @@
 package util
 
 import (
+	"crypto/rand"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -12,6 +14,18 @@ import (
 	"syscall"
 )
 
+//Returns a random (version 4) UUID
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
 func EnsureDirExists(dir string) error {
 	_, err := os.Lstat(dir)
 	if err != nil {
@@ -40,16 +54,6 @@ func FileExistsAndHasPermissions(file string, mode os.FileMode) bool {
 	return info.Mode().Perm() == mode
 }
 
-//TODO maybe this shouldn't fail silently?
-func RecursiveRemoveEmptyDirs(dir string) {
-	var err error = nil
-	curDir := dir
-	for err == nil {
-		err = os.Remove(curDir)
-		curDir = path.Dir(curDir)
-	}
-}
-
 func CopyReaderToTmp(src io.Reader, tmpdir string) (string, error) {
 	outfile, err := ioutil.TempFile(tmpdir, "asink")
 	if err != nil {